@@ -4,18 +4,29 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"example.com/csiproject/backend/model"
 )
 
 type Client struct {
+	// Scheme is "http" or "https", defaulting to "http" when empty.
+	Scheme   string
 	Hostname string
 	Port     string
 	Username string
 	Password string
+	// Token is a bearer API token, used instead of Username and Password
+	// when set.
+	Token string
+	// HTTPClient sends the requests, http.DefaultClient when nil. Use
+	// NewHTTPClient to talk to a backend serving TLS.
+	HTTPClient *http.Client
 }
 
 type GetVolumeResponse struct {
@@ -27,6 +38,12 @@ type CreateVolumeResponse struct {
 type GetAllVolumesResponse struct {
 	Volumes []model.Volume
 }
+type GetSnapshotResponse struct {
+	Snapshot model.Snapshot
+}
+type GetAllSnapshotsResponse struct {
+	Snapshots []model.Snapshot
+}
 
 func NewClient(hostname, port string) *Client {
 	c := Client{
@@ -37,11 +54,34 @@ func NewClient(hostname, port string) *Client {
 
 }
 
+// baseURL returns the scheme, host and port that request URLs start with.
+func (c Client) baseURL() string {
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + net.JoinHostPort(c.Hostname, c.Port)
+}
+
+// do sends the request with the client's credentials.
+func (c Client) do(r *http.Request) (*http.Response, error) {
+	slog.Debug("backend request", "method", r.Method, "url", r.URL.String())
+	switch {
+	case c.Token != "":
+		r.Header.Set("Authorization", "Bearer "+c.Token)
+	case c.Username != "":
+		r.SetBasicAuth(c.Username, c.Password)
+	}
+	if c.HTTPClient != nil {
+		return c.HTTPClient.Do(r)
+	}
+	return http.DefaultClient.Do(r)
+}
+
 func (c Client) GetAllVolumes(reqContext context.Context) (*GetAllVolumesResponse, error) {
 
-	url := fmt.Sprintf("http://%s:%s/volumes", c.Hostname, c.Port)
-	fmt.Printf("url %s\n", url)
-	mm, err := Get[[]model.Volume](reqContext, url)
+	url := c.baseURL() + "/volumes"
+	mm, err := Get[[]model.Volume](reqContext, c, url)
 	if err != nil {
 		return nil, err
 	}
@@ -52,9 +92,21 @@ func (c Client) GetAllVolumes(reqContext context.Context) (*GetAllVolumesRespons
 }
 func (c Client) GetVolume(reqContext context.Context, id string) (*GetVolumeResponse, error) {
 
-	url := fmt.Sprintf("http://%s:%s/volumes/%s", c.Hostname, c.Port, id)
-	fmt.Printf("url %s\n", url)
-	m, err := Get[model.Volume](reqContext, url)
+	url := c.baseURL() + "/volumes/" + url.PathEscape(id)
+	m, err := Get[model.Volume](reqContext, c, url)
+	if err != nil {
+		return nil, err
+	}
+	resp := GetVolumeResponse{
+		Volume: m,
+	}
+	return &resp, nil
+}
+
+func (c Client) GetVolumeByName(reqContext context.Context, name string) (*GetVolumeResponse, error) {
+
+	url := c.baseURL() + "/volumes?name=" + url.QueryEscape(name)
+	m, err := Get[model.Volume](reqContext, c, url)
 	if err != nil {
 		return nil, err
 	}
@@ -64,25 +116,18 @@ func (c Client) GetVolume(reqContext context.Context, id string) (*GetVolumeResp
 	return &resp, nil
 }
 
-func Get[T any](ctx context.Context, url string) (T, error) {
+func Get[T any](ctx context.Context, c Client, url string) (T, error) {
 	var m T
 	r, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return m, err
 	}
-	res, err := http.DefaultClient.Do(r)
+	res, err := c.do(r)
 	if err != nil {
 		return m, err
 	}
-	switch res.StatusCode {
-	case 200:
-		fmt.Println("work!")
-	case 404:
-		fmt.Println("not found!")
-		return m, fmt.Errorf("GET %s not found returned", url)
-	default:
-		fmt.Printf("bad status code from GET %d\n", res.StatusCode)
-		return m, fmt.Errorf("GET %s bad statuscode %d returned", url, res.StatusCode)
+	if res.StatusCode != 200 {
+		return m, responseError("GET", url, res)
 	}
 	body, err := io.ReadAll(res.Body)
 	res.Body.Close()
@@ -91,6 +136,32 @@ func Get[T any](ctx context.Context, url string) (T, error) {
 	}
 	return parseJSON[T](body)
 }
+
+// responseError builds the *APIError for a failed request from the
+// backend's JSON error response.
+func responseError(method, url string, res *http.Response) error {
+	apiErr := &APIError{
+		Method:     method,
+		URL:        url,
+		StatusCode: res.StatusCode,
+	}
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err == nil {
+		// Not every failure carries a JSON body (a proxy in the way, say), in
+		// which case only the status code is known.
+		var body struct {
+			Error string                 `json:"error"`
+			Data  map[string]interface{} `json:"data"`
+		}
+		if json.Unmarshal(b, &body) == nil {
+			apiErr.Code = body.Error
+			apiErr.Data = body.Data
+		}
+	}
+	return apiErr
+}
+
 func parseJSON[T any](s []byte) (T, error) {
 	var r T
 	if err := json.Unmarshal(s, &r); err != nil {
@@ -105,9 +176,8 @@ func toJSON(T any) ([]byte, error) {
 
 func (c Client) CreateVolume(reqContext context.Context, newVolume model.Volume) (*CreateVolumeResponse, error) {
 
-	url := fmt.Sprintf("http://%s:%s/volumes", c.Hostname, c.Port)
-	fmt.Printf("url %s\n", url)
-	newVolume, err := Post[model.Volume](reqContext, url, newVolume)
+	url := c.baseURL() + "/volumes"
+	newVolume, err := Post[model.Volume](reqContext, c, url, newVolume)
 	if err != nil {
 		return nil, err
 	}
@@ -116,7 +186,7 @@ func (c Client) CreateVolume(reqContext context.Context, newVolume model.Volume)
 	}
 	return &resp, nil
 }
-func Post[T any](ctx context.Context, url string, data any) (T, error) {
+func Post[T any](ctx context.Context, c Client, url string, data any) (T, error) {
 	var m T
 	b, err := toJSON(data)
 	if err != nil {
@@ -129,19 +199,12 @@ func Post[T any](ctx context.Context, url string, data any) (T, error) {
 	}
 	// Important to set
 	r.Header.Add("Content-Type", "application/json")
-	res, err := http.DefaultClient.Do(r)
+	res, err := c.do(r)
 	if err != nil {
 		return m, err
 	}
-	switch res.StatusCode {
-	case 200, 201:
-		fmt.Println("POST work!")
-	case 404:
-		fmt.Println("not found!")
-		return m, fmt.Errorf("POST %s not found returned", url)
-	default:
-		fmt.Printf("bad status code from POST %d\n", res.StatusCode)
-		return m, fmt.Errorf("POST %s bad statuscode %d returned", url, res.StatusCode)
+	if res.StatusCode != 200 && res.StatusCode != 201 {
+		return m, responseError("POST", url, res)
 	}
 	body, err := io.ReadAll(res.Body)
 	res.Body.Close()
@@ -153,25 +216,18 @@ func Post[T any](ctx context.Context, url string, data any) (T, error) {
 
 func (c Client) DeleteVolume(reqContext context.Context, id string) error {
 
-	url := fmt.Sprintf("http://%s:%s/volumes/%s", c.Hostname, c.Port, id)
-	fmt.Printf("url %s\n", url)
+	url := c.baseURL() + "/volumes/" + url.PathEscape(id)
 	r, err := http.NewRequestWithContext(reqContext, "DELETE", url, nil)
 	if err != nil {
 		return err
 	}
-	res, err := http.DefaultClient.Do(r)
+	res, err := c.do(r)
 	if err != nil {
 		return err
 	}
-	switch res.StatusCode {
-	case 200:
-		fmt.Println("work!")
-	case 404:
-		fmt.Println("not found!")
-		return fmt.Errorf("DELETE %s not found returned", url)
-	default:
-		fmt.Printf("bad status code from DELETE %d\n", res.StatusCode)
-		return fmt.Errorf("DELETE %s bad statuscode %d returned", url, res.StatusCode)
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return responseError("DELETE", url, res)
 	}
 	/**
 	body, err := io.ReadAll(res.Body)
@@ -182,3 +238,174 @@ func (c Client) DeleteVolume(reqContext context.Context, id string) error {
 	*/
 	return nil
 }
+
+// ExpandVolume grows the volume to sizeBytes. It succeeds if the volume is
+// already that large.
+func (c Client) ExpandVolume(reqContext context.Context, id string, sizeBytes int64) (*GetVolumeResponse, error) {
+
+	url := c.baseURL() + "/volumes/" + url.PathEscape(id)
+	m, err := Patch[model.Volume](reqContext, c, url, map[string]string{"size": strconv.FormatInt(sizeBytes, 10)})
+	if err != nil {
+		return nil, err
+	}
+	resp := GetVolumeResponse{
+		Volume: m,
+	}
+	return &resp, nil
+}
+
+// AllowHost lets the host NQN connect to the volume's subsystem. It succeeds
+// if the host is already allowed.
+func (c Client) AllowHost(reqContext context.Context, id, hostNQN string) (*GetVolumeResponse, error) {
+
+	url := c.baseURL() + "/volumes/" + url.PathEscape(id) + "/hosts/" + url.PathEscape(hostNQN)
+	m, err := Put[model.Volume](reqContext, c, url)
+	if err != nil {
+		return nil, err
+	}
+	resp := GetVolumeResponse{
+		Volume: m,
+	}
+	return &resp, nil
+}
+
+// RevokeHost removes the host NQN's access to the volume's subsystem. It
+// succeeds if the host wasn't allowed.
+func (c Client) RevokeHost(reqContext context.Context, id, hostNQN string) error {
+
+	url := c.baseURL() + "/volumes/" + url.PathEscape(id) + "/hosts/" + url.PathEscape(hostNQN)
+	_, err := Delete[model.Volume](reqContext, c, url)
+	return err
+}
+
+// RevokeAllHosts removes every host's access to the volume's subsystem.
+func (c Client) RevokeAllHosts(reqContext context.Context, id string) error {
+
+	url := c.baseURL() + "/volumes/" + url.PathEscape(id) + "/hosts"
+	_, err := Delete[model.Volume](reqContext, c, url)
+	return err
+}
+
+// Put sends a PUT without a body and decodes the JSON response.
+func Put[T any](ctx context.Context, c Client, url string) (T, error) {
+	return send[T](ctx, c, "PUT", url, nil)
+}
+
+// Patch sends data as a JSON PATCH and decodes the JSON response.
+func Patch[T any](ctx context.Context, c Client, url string, data any) (T, error) {
+	return send[T](ctx, c, "PATCH", url, data)
+}
+
+// Delete sends a DELETE and decodes the JSON response.
+func Delete[T any](ctx context.Context, c Client, url string) (T, error) {
+	return send[T](ctx, c, "DELETE", url, nil)
+}
+
+// send sends a request, with data as its JSON body unless it is nil, and
+// decodes the JSON response.
+func send[T any](ctx context.Context, c Client, method, url string, data any) (T, error) {
+	var m T
+	var reqBody io.Reader
+	if data != nil {
+		b, err := toJSON(data)
+		if err != nil {
+			return m, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	r, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return m, err
+	}
+	if data != nil {
+		r.Header.Add("Content-Type", "application/json")
+	}
+	res, err := c.do(r)
+	if err != nil {
+		return m, err
+	}
+	if res.StatusCode != 200 {
+		return m, responseError(method, url, res)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return m, err
+	}
+	return parseJSON[T](body)
+}
+
+func (c Client) GetAllSnapshots(reqContext context.Context) (*GetAllSnapshotsResponse, error) {
+
+	url := c.baseURL() + "/snapshots"
+	m, err := Get[[]model.Snapshot](reqContext, c, url)
+	if err != nil {
+		return nil, err
+	}
+	resp := GetAllSnapshotsResponse{
+		Snapshots: m,
+	}
+	return &resp, nil
+}
+
+// GetVolumeSnapshots returns the snapshots taken of a volume.
+func (c Client) GetVolumeSnapshots(reqContext context.Context, volumeID string) (*GetAllSnapshotsResponse, error) {
+
+	url := c.baseURL() + "/volumes/" + url.PathEscape(volumeID) + "/snapshots"
+	m, err := Get[[]model.Snapshot](reqContext, c, url)
+	if err != nil {
+		return nil, err
+	}
+	resp := GetAllSnapshotsResponse{
+		Snapshots: m,
+	}
+	return &resp, nil
+}
+
+func (c Client) GetSnapshot(reqContext context.Context, id string) (*GetSnapshotResponse, error) {
+
+	url := c.baseURL() + "/snapshots/" + url.PathEscape(id)
+	m, err := Get[model.Snapshot](reqContext, c, url)
+	if err != nil {
+		return nil, err
+	}
+	resp := GetSnapshotResponse{
+		Snapshot: m,
+	}
+	return &resp, nil
+}
+
+func (c Client) GetSnapshotByName(reqContext context.Context, name string) (*GetSnapshotResponse, error) {
+
+	url := c.baseURL() + "/snapshots?name=" + url.QueryEscape(name)
+	m, err := Get[model.Snapshot](reqContext, c, url)
+	if err != nil {
+		return nil, err
+	}
+	resp := GetSnapshotResponse{
+		Snapshot: m,
+	}
+	return &resp, nil
+}
+
+// CreateSnapshot takes a snapshot of a volume. Only the ID and name of
+// newSnapshot are used, the backend fills in the rest.
+func (c Client) CreateSnapshot(reqContext context.Context, volumeID string, newSnapshot model.Snapshot) (*GetSnapshotResponse, error) {
+
+	url := c.baseURL() + "/volumes/" + url.PathEscape(volumeID) + "/snapshots"
+	m, err := Post[model.Snapshot](reqContext, c, url, newSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	resp := GetSnapshotResponse{
+		Snapshot: m,
+	}
+	return &resp, nil
+}
+
+func (c Client) DeleteSnapshot(reqContext context.Context, id string) error {
+
+	url := c.baseURL() + "/snapshots/" + url.PathEscape(id)
+	_, err := Delete[struct{}](reqContext, c, url)
+	return err
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error codes sent by the backend in the "error" field of its JSON error
+// responses.
+const (
+	CodeAlreadyExists    = "already-exists"
+	CodeDatabase         = "database"
+	CodeEngine           = "engine"
+	CodeInternal         = "internal"
+	CodeMalformedJSON    = "malformed-json"
+	CodeMethodNotAllowed = "method-not-allowed"
+	CodeNotFound         = "not-found"
+	CodeUnauthorized     = "unauthorized"
+	CodeTarget           = "target"
+	CodeValidation       = "validation"
+)
+
+// APIError is returned when the backend answers a request with an error
+// status. It carries the status code along with the error code and
+// validation data from the backend's JSON error response.
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Code       string
+	Data       map[string]interface{}
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s %s bad statuscode %d returned", e.Method, e.URL, e.StatusCode)
+	}
+	if len(e.Data) > 0 {
+		return fmt.Sprintf("%s %s returned %d %s: %v", e.Method, e.URL, e.StatusCode, e.Code, e.Data)
+	}
+	return fmt.Sprintf("%s %s returned %d %s", e.Method, e.URL, e.StatusCode, e.Code)
+}
+
+// IsNotFound reports whether err is an APIError for a resource that does
+// not exist.
+func IsNotFound(err error) bool {
+	return hasCode(err, CodeNotFound, http.StatusNotFound)
+}
+
+// IsAlreadyExists reports whether err is an APIError for a resource that
+// already exists.
+func IsAlreadyExists(err error) bool {
+	return hasCode(err, CodeAlreadyExists, http.StatusConflict)
+}
+
+// IsValidation reports whether err is an APIError for a request the backend
+// rejected as invalid. The offending fields are in the error's Data.
+func IsValidation(err error) bool {
+	return hasCode(err, CodeValidation, http.StatusBadRequest)
+}
+
+// IsUnauthorized reports whether err is an APIError for a request the
+// backend rejected for missing or invalid credentials.
+func IsUnauthorized(err error) bool {
+	return hasCode(err, CodeUnauthorized, http.StatusUnauthorized)
+}
+
+// IsDatabase reports whether err is an APIError for a failure in the
+// backend's database.
+func IsDatabase(err error) bool {
+	return hasCode(err, CodeDatabase, http.StatusInternalServerError)
+}
+
+// hasCode reports whether err is an APIError with the given error code. A
+// response without a JSON body falls back to matching the status code.
+func hasCode(err error, code string, statusCode int) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == "" {
+		return apiErr.StatusCode == statusCode
+	}
+	return apiErr.Code == code
+}
@@ -19,7 +19,8 @@ func main() {
 
 	ctx := context.Background()
 	timeout := 30 * time.Second
-	reqContext, _ := context.WithTimeout(ctx, timeout)
+	reqContext, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	someVolume, err := client.GetVolume(reqContext, "1")
 	if err != nil {
 		log.Fatal(err)
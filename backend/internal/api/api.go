@@ -1,42 +1,92 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 
 	"example.com/csiproject/backend/internal/db"
+	"example.com/csiproject/backend/internal/engine"
+	"example.com/csiproject/backend/internal/nvmet"
 	"example.com/csiproject/backend/model"
 )
 
 // Server is the volume HTTP server.
 type Server struct {
-	db  db.Database
-	log *log.Logger
+	db     db.Database
+	log    *log.Logger
+	auth   *Authenticator
+	target *nvmet.Target
+	engine engine.StorageEngine
 }
 
 const (
 	ErrorAlreadyExists    = "already-exists"
 	ErrorDatabase         = "database"
+	ErrorEngine           = "engine"
 	ErrorInternal         = "internal"
 	ErrorMalformedJSON    = "malformed-json"
 	ErrorMethodNotAllowed = "method-not-allowed"
 	ErrorNotFound         = "not-found"
+	ErrorUnauthorized     = "unauthorized"
+	ErrorTarget           = "target"
 	ErrorValidation       = "validation"
 )
 
+// subsystemNQNPrefix is prepended to the volume ID to name the NVMe
+// subsystem a volume is exported as.
+const subsystemNQNPrefix = "nqn.2024-02.com.example.csi:"
+
+// SubsystemNQN returns the NQN of the subsystem the volume with the given ID
+// is exported as, unless it was created with one of its own.
+func SubsystemNQN(id string) string {
+	return subsystemNQNPrefix + id
+}
+
+// defaultNVMePort is the NVMe/TCP service id used when a volume's hostport
+// has no port.
+const defaultNVMePort = "4420"
+
+// allocationUnit is the granularity, in bytes, at which volume space is
+// allocated. Requested sizes are rounded up to a multiple of it.
+const allocationUnit = 1 << 20
+
 // NewServer creates a new server using the given database implementation.
 func NewServer(db db.Database, log *log.Logger) *Server {
 	return &Server{db: db, log: log}
 }
 
+// RequireAuth makes the server reject any request that the authenticator
+// does not accept.
+func (s *Server) RequireAuth(auth *Authenticator) {
+	s.auth = auth
+}
+
 // Regex to match "/volumes/:id" (id must be one or more non-slash chars).
 var reVolumesID = regexp.MustCompile(`^/volumes/([^/]+)$`)
 
+// Regexes to match "/volumes/:id/hosts" and "/volumes/:id/hosts/:nqn".
+var (
+	reVolumeHosts = regexp.MustCompile(`^/volumes/([^/]+)/hosts$`)
+	reVolumeHost  = regexp.MustCompile(`^/volumes/([^/]+)/hosts/([^/]+)$`)
+)
+
+// Regexes to match "/volumes/:id/snapshots" and "/snapshots/:id".
+var (
+	reVolumeSnapshots = regexp.MustCompile(`^/volumes/([^/]+)/snapshots$`)
+	reSnapshotsID     = regexp.MustCompile(`^/snapshots/([^/]+)$`)
+)
+
 // ServeHTTP routes the request and calls the correct handler based on the URL
 // and HTTP method. It writes a 404 Not Found if the request URL is unknown,
 // or 405 Method Not Allowed if the request method is invalid.
@@ -44,12 +94,22 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	s.log.Printf("%s %s", r.Method, path)
 
-	var id string
+	if s.auth != nil && !s.auth.Authenticate(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="csi-backend"`)
+		s.jsonError(w, http.StatusUnauthorized, ErrorUnauthorized, nil)
+		return
+	}
+
+	var id, hostNQN string
 
 	switch {
 	case path == "/volumes":
 		switch r.Method {
 		case "GET":
+			if r.URL.Query().Has("name") {
+				s.getVolumeByName(w, r, r.URL.Query().Get("name"))
+				return
+			}
 			s.getVolumes(w, r)
 		case "POST":
 			s.addVolume(w, r)
@@ -62,8 +122,74 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
 			s.getVolumeByID(w, r, id)
+		case "PATCH":
+			s.resizeVolume(w, r, id)
 		case "DELETE":
 			s.deleteVolumeByID(w, r, id)
+		default:
+			w.Header().Set("Allow", "GET, PATCH, DELETE")
+			s.jsonError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, nil)
+		}
+
+	case match(path, reVolumeHosts, &id):
+		switch r.Method {
+		case "DELETE":
+			s.removeAllowedHosts(w, r, id)
+		default:
+			w.Header().Set("Allow", "DELETE")
+			s.jsonError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, nil)
+		}
+
+	case match(path, reVolumeHost, &id, &hostNQN):
+		switch r.Method {
+		case "PUT":
+			s.addAllowedHost(w, r, id, hostNQN)
+		case "DELETE":
+			s.removeAllowedHost(w, r, id, hostNQN)
+		default:
+			w.Header().Set("Allow", "PUT, DELETE")
+			s.jsonError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, nil)
+		}
+
+	case match(path, reVolumeSnapshots, &id):
+		switch r.Method {
+		case "GET":
+			s.getVolumeSnapshots(w, r, id)
+		case "POST":
+			s.addSnapshot(w, r, id)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			s.jsonError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, nil)
+		}
+
+	case path == "/snapshots":
+		switch r.Method {
+		case "GET":
+			if r.URL.Query().Has("name") {
+				s.getSnapshotByName(w, r, r.URL.Query().Get("name"))
+				return
+			}
+			s.getSnapshots(w, r)
+		default:
+			w.Header().Set("Allow", "GET")
+			s.jsonError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, nil)
+		}
+
+	case match(path, reSnapshotsID, &id):
+		switch r.Method {
+		case "GET":
+			s.getSnapshotByID(w, r, id)
+		case "DELETE":
+			s.deleteSnapshotByID(w, r, id)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			s.jsonError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, nil)
+		}
+
+	case path == "/usage":
+		switch r.Method {
+		case "GET":
+			s.getUsage(w, r)
 		default:
 			w.Header().Set("Allow", "GET")
 			s.jsonError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, nil)
@@ -117,16 +243,60 @@ func (s *Server) addVolume(w http.ResponseWriter, r *http.Request) {
 	}
 	if volume.Size == "" {
 		issues["size"] = validationIssue{"required", ""}
+	} else if size, err := model.ParseSize(volume.Size); err != nil || size == 0 {
+		issues["size"] = validationIssue{"invalid", volume.Size}
+	} else {
+		volume.CapacityBytes = roundUp(size, allocationUnit)
 	}
 	if volume.Name == "" {
 		issues["name"] = validationIssue{"required", ""}
 	}
+	if volume.SubsystemNQN != "" && !validNQN(volume.SubsystemNQN) {
+		issues["subsystem_nqn"] = validationIssue{"invalid", volume.SubsystemNQN}
+	}
+	if volume.SourceSnapshotID != "" || volume.SourceVolumeID != "" {
+		if volume.SourceSnapshotID != "" && volume.SourceVolumeID != "" {
+			issues["source"] = validationIssue{"invalid", "only one of source_snapshot_id and source_volume_id may be set"}
+		} else if s.engine == nil {
+			issues["source"] = validationIssue{"unsupported", "no storage engine configured to copy the source with"}
+		}
+	}
 	if len(issues) > 0 {
 		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
 		return
 	}
 
-	err := s.db.AddVolume(volume)
+	sourceBytes, err := s.sourceSize(volume)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, map[string]interface{}{"message": "source not found"})
+		return
+	} else if err != nil {
+		s.log.Printf("error looking up source of volume ID %q: %v", volume.ID, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	if volume.CapacityBytes < sourceBytes {
+		issues["size"] = validationIssue{"smaller-than-source", strconv.FormatInt(sourceBytes, 10)}
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
+		return
+	}
+
+	if volume.SubsystemNQN == "" {
+		volume.SubsystemNQN = SubsystemNQN(volume.ID)
+	}
+	if volume.NamespaceUUID == "" {
+		uuid, err := newUUID()
+		if err != nil {
+			s.log.Printf("error generating namespace UUID: %v", err)
+			s.jsonError(w, http.StatusInternalServerError, ErrorInternal, nil)
+			return
+		}
+		volume.NamespaceUUID = uuid
+	}
+	volume.Context = volumeContext(volume)
+	volume.Provisioning = true
+
+	err = s.db.AddVolume(volume)
 	if errors.Is(err, db.ErrAlreadyExists) {
 		s.jsonError(w, http.StatusConflict, ErrorAlreadyExists, nil)
 		return
@@ -136,13 +306,72 @@ func (s *Server) addVolume(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Provisioning carries on when the client gives up waiting, so the
+	// engine isn't killed halfway through and the cleanup can still run.
+	ctx := context.WithoutCancel(r.Context())
+	volume, err = s.provisionVolume(ctx, volume)
+	if err != nil {
+		s.log.Printf("error provisioning volume ID %q: %v", volume.ID, err)
+		// Don't leave a record, or half a volume, behind for a volume that
+		// was never usable. Whatever a failed cleanup leaves is freed by
+		// the next attempt to create the volume.
+		if err := s.deprovisionVolume(ctx, volume); err != nil {
+			s.log.Printf("error cleaning up volume ID %q: %v", volume.ID, err)
+		}
+		if _, err := s.db.DeleteVolumeByID(volume.ID); err != nil {
+			s.log.Printf("error removing volume ID %q: %v", volume.ID, err)
+		}
+		s.jsonError(w, http.StatusInternalServerError, provisionErrorCode(err), nil)
+		return
+	}
+
 	s.writeJSON(w, http.StatusCreated, volume)
 }
 
+// roundUp rounds size up to the next multiple of unit.
+func roundUp(size, unit int64) int64 {
+	return (size + unit - 1) / unit * unit
+}
+
+// volumeContext builds the context returned to the CO for a new volume. It
+// carries the StorageClass parameters, minus the reserved
+// "csi.storage.k8s.io/" keys, along with the NVMe/TCP target the volume is
+// served from.
+func volumeContext(volume model.Volume) map[string]string {
+	ctx := make(map[string]string, len(volume.Parameters)+6)
+	for k, v := range volume.Parameters {
+		if strings.HasPrefix(k, "csi.storage.k8s.io/") {
+			continue
+		}
+		ctx[k] = v
+	}
+	address, port, err := net.SplitHostPort(volume.Hostport)
+	if err != nil {
+		address, port = volume.Hostport, defaultNVMePort
+	}
+	ctx["hostport"] = volume.Hostport
+	ctx[model.ContextTransport] = "tcp"
+	ctx[model.ContextAddress] = address
+	ctx[model.ContextPort] = port
+	ctx[model.ContextSubsystemNQN] = volume.SubsystemNQN
+	ctx[model.ContextNamespaceUUID] = volume.NamespaceUUID
+	return ctx
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
 func (s *Server) getVolumeByID(w http.ResponseWriter, r *http.Request, id string) {
 	volume, err := s.db.GetVolumeByID(id)
 	if errors.Is(err, db.ErrDoesNotExist) {
-		fmt.Printf("jeff error here in getVolumeByID %s\n", err.Error())
 		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
 		return
 	} else if err != nil {
@@ -152,7 +381,36 @@ func (s *Server) getVolumeByID(w http.ResponseWriter, r *http.Request, id string
 	}
 	s.writeJSON(w, http.StatusOK, volume)
 }
+func (s *Server) getVolumeByName(w http.ResponseWriter, r *http.Request, name string) {
+	volume, err := s.db.GetVolumeByName(name)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.log.Printf("error fetching volume name %q: %v", name, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, volume)
+}
+
 func (s *Server) deleteVolumeByID(w http.ResponseWriter, r *http.Request, id string) {
+	volume, err := s.db.GetVolumeByID(id)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.log.Printf("error fetching volume ID %q: %v", id, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	// Keep the record until the volume is gone, so a failed delete can be
+	// retried.
+	if err := s.deprovisionVolume(r.Context(), volume); err != nil {
+		s.log.Printf("error deprovisioning volume ID %q: %v", id, err)
+		s.jsonError(w, http.StatusInternalServerError, provisionErrorCode(err), nil)
+		return
+	}
 	deleteResponse, err := s.db.DeleteVolumeByID(id)
 	if errors.Is(err, db.ErrDoesNotExist) {
 		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
@@ -165,6 +423,124 @@ func (s *Server) deleteVolumeByID(w http.ResponseWriter, r *http.Request, id str
 	s.writeJSON(w, http.StatusOK, deleteResponse)
 }
 
+// addAllowedHost lets the host NQN connect to the volume's subsystem. Adding
+// a host that is already allowed succeeds without changing anything.
+func (s *Server) addAllowedHost(w http.ResponseWriter, r *http.Request, id, hostNQN string) {
+	if !strings.HasPrefix(hostNQN, "nqn.") {
+		data := map[string]interface{}{"host": map[string]string{"error": "invalid", "message": hostNQN}}
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, data)
+		return
+	}
+	s.updateVolume(w, id, func(volume *model.Volume) error {
+		if !slices.Contains(volume.AllowedHosts, hostNQN) {
+			volume.AllowedHosts = append(volume.AllowedHosts, hostNQN)
+		}
+		return nil
+	})
+}
+
+// resizeRequest is the body of a PATCH /volumes/{id} request.
+type resizeRequest struct {
+	Size string `json:"size"`
+}
+
+// resizeVolume grows a volume to the size in the request, telling hosts
+// using it about the new size. Volumes can't shrink; asking for the size a
+// volume already has succeeds.
+func (s *Server) resizeVolume(w http.ResponseWriter, r *http.Request, id string) {
+	var req resizeRequest
+	if !s.readJSON(w, r, &req) {
+		return
+	}
+	size, err := model.ParseSize(req.Size)
+	if req.Size == "" {
+		data := map[string]interface{}{"size": map[string]string{"error": "required"}}
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, data)
+		return
+	} else if err != nil || size == 0 {
+		data := map[string]interface{}{"size": map[string]string{"error": "invalid", "message": req.Size}}
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, data)
+		return
+	}
+	capacity := roundUp(size, allocationUnit)
+
+	volume, err := s.db.GetVolumeByID(id)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.log.Printf("error fetching volume ID %q: %v", id, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	if capacity < volume.CapacityBytes {
+		data := map[string]interface{}{"size": map[string]string{"error": "smaller-than-current", "message": strconv.FormatInt(volume.CapacityBytes, 10)}}
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, data)
+		return
+	}
+	if capacity > volume.CapacityBytes {
+		if err := s.growVolume(r.Context(), volume, capacity); err != nil {
+			s.log.Printf("error resizing volume ID %q: %v", id, err)
+			s.jsonError(w, http.StatusInternalServerError, provisionErrorCode(err), nil)
+			return
+		}
+	}
+	s.updateVolume(w, id, func(volume *model.Volume) error {
+		if capacity > volume.CapacityBytes {
+			volume.Size = req.Size
+			volume.CapacityBytes = capacity
+		}
+		return nil
+	})
+}
+
+// removeAllowedHost revokes the host NQN's access to the volume's
+// subsystem. Removing a host that isn't allowed succeeds.
+func (s *Server) removeAllowedHost(w http.ResponseWriter, r *http.Request, id, hostNQN string) {
+	s.updateVolume(w, id, func(volume *model.Volume) error {
+		volume.AllowedHosts = slices.DeleteFunc(volume.AllowedHosts, func(h string) bool {
+			return h == hostNQN
+		})
+		return nil
+	})
+}
+
+// removeAllowedHosts revokes every host's access to the volume's subsystem.
+func (s *Server) removeAllowedHosts(w http.ResponseWriter, r *http.Request, id string) {
+	s.updateVolume(w, id, func(volume *model.Volume) error {
+		volume.AllowedHosts = nil
+		return nil
+	})
+}
+
+// updateVolume applies update to the stored volume, brings the target in
+// line with the result and writes it.
+func (s *Server) updateVolume(w http.ResponseWriter, id string, update func(*model.Volume) error) {
+	volume, err := s.db.UpdateVolume(id, func(volume *model.Volume) error {
+		if s.target != nil && volume.SubsystemNQN == "" {
+			return errNoSubsystem
+		}
+		return update(volume)
+	})
+	if errors.Is(err, db.ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if errors.Is(err, errNoSubsystem) {
+		s.jsonError(w, http.StatusConflict, ErrorTarget, map[string]interface{}{"message": err.Error()})
+		return
+	} else if err != nil {
+		s.log.Printf("error updating volume ID %q: %v", id, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	if err := s.exportVolume(volume); err != nil {
+		s.log.Printf("error exporting volume ID %q: %v", id, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorTarget, nil)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, volume)
+}
+
 // writeJSON marshals v to JSON and writes it to the response, handling
 // errors as appropriate. It also sets the Content-Type header to
 // "application/json".
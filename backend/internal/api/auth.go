@@ -0,0 +1,95 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Authenticator checks the credentials on incoming requests, accepting
+// either HTTP basic auth for a configured user or a bearer API token.
+type Authenticator struct {
+	users  map[string][sha256.Size]byte
+	tokens [][sha256.Size]byte
+}
+
+// NewAuthenticator creates an authenticator for the given username to
+// password map and list of API tokens.
+func NewAuthenticator(users map[string]string, tokens []string) *Authenticator {
+	a := &Authenticator{users: make(map[string][sha256.Size]byte, len(users))}
+	for user, password := range users {
+		a.users[user] = sha256.Sum256([]byte(password))
+	}
+	for _, token := range tokens {
+		a.tokens = append(a.tokens, sha256.Sum256([]byte(token)))
+	}
+	return a
+}
+
+// Authenticate reports whether the request carries valid credentials.
+// Secrets are compared by hash in constant time so neither their length nor
+// content leaks through timing.
+func (a *Authenticator) Authenticate(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		want, known := a.users[user]
+		got := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare(want[:], got[:]) == 1 && known
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	got := sha256.Sum256([]byte(token))
+	valid := 0
+	for _, want := range a.tokens {
+		valid |= subtle.ConstantTimeCompare(want[:], got[:])
+	}
+	return valid == 1
+}
+
+// ReadUsersFile reads "username:password" lines from path. Blank lines and
+// lines starting with "#" are ignored.
+func ReadUsersFile(path string) (map[string]string, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string, len(lines))
+	for i, line := range lines {
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:password", path, i+1)
+		}
+		users[user] = password
+	}
+	return users, nil
+}
+
+// ReadTokensFile reads one API token per line from path. Blank lines and
+// lines starting with "#" are ignored.
+func ReadTokensFile(path string) ([]string, error) {
+	return readLines(path)
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
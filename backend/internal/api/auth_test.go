@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"example.com/csiproject/backend/internal/db"
+)
+
+func newAuthenticator() *Authenticator {
+	return NewAuthenticator(map[string]string{"csi": "s3cret", "admin": "hunter2"}, []string{"token-1", "token-2"})
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		user   string
+		pass   string
+		want   bool
+	}{
+		{name: "valid basic credentials", user: "csi", pass: "s3cret", want: true},
+		{name: "wrong password", user: "csi", pass: "hunter2"},
+		{name: "empty password", user: "csi"},
+		{name: "unknown user", user: "nobody", pass: "s3cret"},
+		{name: "valid token", header: "Bearer token-1", want: true},
+		{name: "another valid token", header: "Bearer token-2", want: true},
+		{name: "invalid token", header: "Bearer token-3"},
+		{name: "empty token", header: "Bearer "},
+		{name: "token without scheme", header: "token-1"},
+		{name: "other scheme", header: "Digest token-1"},
+		{name: "no authorization header"},
+	}
+	a := newAuthenticator()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/volumes", nil)
+			if test.user != "" {
+				r.SetBasicAuth(test.user, test.pass)
+			} else if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			if got := a.Authenticate(r); got != test.want {
+				t.Errorf("Authenticate() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Without users or tokens nothing is let in.
+	r := httptest.NewRequest("GET", "/volumes", nil)
+	r.SetBasicAuth("", "")
+	if NewAuthenticator(nil, nil).Authenticate(r) {
+		t.Error("an empty authenticator accepted empty basic credentials")
+	}
+}
+
+func TestServeHTTPAuth(t *testing.T) {
+	s := NewServer(db.NewMemoryDatabase(), log.New(io.Discard, "", 0))
+	s.RequireAuth(newAuthenticator())
+
+	for _, header := range []string{"", "Bearer wrong"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/volumes", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("status with %q = %d, want %d", header, w.Code, http.StatusUnauthorized)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); got != `Basic realm="csi-backend"` {
+			t.Errorf("WWW-Authenticate = %q", got)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]interface{}{"status": float64(http.StatusUnauthorized), "error": ErrorUnauthorized}
+		if !reflect.DeepEqual(body, want) {
+			t.Errorf("body = %v, want %v", body, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/volumes", nil)
+	r.SetBasicAuth("csi", "s3cret")
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("status with valid credentials = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestReadUsersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	content := "# CSI driver\ncsi:s3cret\n\n  admin:pass:with:colons  \n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ReadUsersFile(path)
+	want := map[string]string{"csi": "s3cret", "admin": "pass:with:colons"}
+	if err != nil || !reflect.DeepEqual(users, want) {
+		t.Errorf("ReadUsersFile() = %v, %v, want %v", users, err, want)
+	}
+
+	for _, line := range []string{"csi", "csi:", ":s3cret"} {
+		if err := os.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadUsersFile(path); err == nil {
+			t.Errorf("ReadUsersFile() of %q succeeded", line)
+		}
+	}
+}
+
+func TestReadTokensFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("token-1\n# old\n\ntoken-2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := ReadTokensFile(path)
+	if err != nil || !reflect.DeepEqual(tokens, []string{"token-1", "token-2"}) {
+		t.Errorf("ReadTokensFile() = %v, %v", tokens, err)
+	}
+	if _, err := ReadTokensFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("ReadTokensFile() of a missing file succeeded")
+	}
+}
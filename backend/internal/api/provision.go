@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"example.com/csiproject/backend/internal/db"
+	"example.com/csiproject/backend/internal/engine"
+	"example.com/csiproject/backend/model"
+)
+
+// UseEngine makes the server allocate the space for its volumes with the
+// given storage engine. Without one, volumes use the path they were
+// created with.
+func (s *Server) UseEngine(e engine.StorageEngine) {
+	s.engine = e
+}
+
+// provisionError is a failure of the storage engine or the target, as
+// opposed to the database.
+type provisionError struct {
+	code string
+	err  error
+}
+
+func (e *provisionError) Error() string { return e.err.Error() }
+func (e *provisionError) Unwrap() error { return e.err }
+
+// provisionErrorCode returns the error code to report a failed provisioning
+// step with.
+func provisionErrorCode(err error) string {
+	var perr *provisionError
+	if errors.As(err, &perr) {
+		return perr.code
+	}
+	return ErrorDatabase
+}
+
+// provisionVolume allocates the space of a newly recorded volume, exports it
+// and marks it provisioned. The returned volume, which on failure is the one
+// passed in, carries the path the volume is exported from.
+func (s *Server) provisionVolume(ctx context.Context, volume model.Volume) (model.Volume, error) {
+	path := volume.Path
+	if s.engine != nil {
+		err := s.allocateVolume(ctx, volume)
+		if errors.Is(err, engine.ErrAlreadyExists) {
+			// The volume's record was only just added, so the space is left
+			// over from an earlier attempt whose cleanup failed. Free it and
+			// start over, the earlier attempt may have had another source.
+			if err = s.engine.Delete(ctx, volume.ID); err == nil {
+				err = s.allocateVolume(ctx, volume)
+			}
+		}
+		if err != nil {
+			return volume, &provisionError{ErrorEngine, err}
+		}
+		if path, err = s.engine.Export(ctx, volume.ID); err != nil {
+			return volume, &provisionError{ErrorEngine, err}
+		}
+	}
+	exported := volume
+	exported.Path = path
+	if err := s.exportVolume(exported); err != nil {
+		return volume, &provisionError{ErrorTarget, err}
+	}
+	updated, err := s.db.UpdateVolume(volume.ID, func(v *model.Volume) error {
+		v.Path = path
+		v.Provisioning = false
+		return nil
+	})
+	if err != nil {
+		return volume, err
+	}
+	return updated, nil
+}
+
+// allocateVolume has the engine create the space of a volume, copying its
+// source if it has one.
+func (s *Server) allocateVolume(ctx context.Context, volume model.Volume) error {
+	if source := volumeSource(volume); source != nil {
+		return s.engine.Clone(ctx, volume.ID, volume.CapacityBytes, *source)
+	}
+	return s.engine.Create(ctx, volume.ID, volume.CapacityBytes)
+}
+
+// AbandonProvisioning removes the volumes that were still being provisioned
+// when the server last stopped, along with whatever space they got, so that
+// creating them again can start over. Call it before serving requests.
+func (s *Server) AbandonProvisioning(ctx context.Context) error {
+	volumes, err := s.db.GetVolumes()
+	if err != nil {
+		return err
+	}
+	for _, volume := range volumes {
+		if !volume.Provisioning {
+			continue
+		}
+		s.log.Printf("removing volume ID %q, which was still being provisioned", volume.ID)
+		if err := s.deprovisionVolume(ctx, volume); err != nil {
+			return fmt.Errorf("cleaning up volume ID %q: %w", volume.ID, err)
+		}
+		if _, err := s.db.DeleteVolumeByID(volume.ID); err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+			return fmt.Errorf("removing volume ID %q: %w", volume.ID, err)
+		}
+	}
+	return nil
+}
+
+// growVolume grows the space of a volume to sizeBytes and has the target
+// pick up the new size. Without an engine there is no space to grow.
+func (s *Server) growVolume(ctx context.Context, volume model.Volume, sizeBytes int64) error {
+	if s.engine == nil {
+		return nil
+	}
+	if err := s.engine.Resize(ctx, volume.ID, sizeBytes); err != nil {
+		return &provisionError{ErrorEngine, err}
+	}
+	if err := s.revalidateVolume(volume); err != nil {
+		return &provisionError{ErrorTarget, err}
+	}
+	return nil
+}
+
+// volumeSource returns the snapshot or volume a volume is created from, or
+// nil for an empty volume.
+func volumeSource(volume model.Volume) *engine.Source {
+	if volume.SourceSnapshotID == "" && volume.SourceVolumeID == "" {
+		return nil
+	}
+	return &engine.Source{SnapshotID: volume.SourceSnapshotID, VolumeID: volume.SourceVolumeID}
+}
+
+// sourceSize returns the size of the snapshot or volume a volume is created
+// from, the smallest the volume can be, or db.ErrDoesNotExist if the source
+// doesn't exist. It is 0 for an empty volume.
+func (s *Server) sourceSize(volume model.Volume) (int64, error) {
+	switch {
+	case volume.SourceSnapshotID != "":
+		snapshot, err := s.db.GetSnapshotByID(volume.SourceSnapshotID)
+		return snapshot.SizeBytes, err
+	case volume.SourceVolumeID != "":
+		source, err := s.db.GetVolumeByID(volume.SourceVolumeID)
+		return source.CapacityBytes, err
+	default:
+		return 0, nil
+	}
+}
+
+// deprovisionVolume stops exporting a volume and frees its space. It is
+// safe to call for a volume that was never, or only partly, provisioned.
+func (s *Server) deprovisionVolume(ctx context.Context, volume model.Volume) error {
+	if err := s.unexportVolume(volume); err != nil {
+		return &provisionError{ErrorTarget, err}
+	}
+	if s.engine != nil {
+		if err := s.engine.Delete(ctx, volume.ID); err != nil {
+			return &provisionError{ErrorEngine, err}
+		}
+	}
+	return nil
+}
+
+func (s *Server) getUsage(w http.ResponseWriter, r *http.Request) {
+	if s.engine == nil {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, map[string]interface{}{"message": "no storage engine configured"})
+		return
+	}
+	usage, err := s.engine.Usage(r.Context())
+	if err != nil {
+		s.log.Printf("error fetching usage: %v", err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorEngine, nil)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, usage)
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example.com/csiproject/backend/internal/db"
+	"example.com/csiproject/backend/internal/engine"
+	"example.com/csiproject/backend/model"
+)
+
+// blockingEngine wraps an engine, holding Create until release is closed
+// and failing Export with exportErr.
+type blockingEngine struct {
+	engine.StorageEngine
+	started   chan struct{}
+	release   chan struct{}
+	createCtx context.Context
+	exportErr error
+}
+
+func (e *blockingEngine) Create(ctx context.Context, id string, sizeBytes int64) error {
+	e.createCtx = ctx
+	if e.release != nil {
+		close(e.started)
+		<-e.release
+	}
+	return e.StorageEngine.Create(ctx, id, sizeBytes)
+}
+
+func (e *blockingEngine) Export(ctx context.Context, id string) (string, error) {
+	if e.exportErr != nil {
+		return "", e.exportErr
+	}
+	return e.StorageEngine.Export(ctx, id)
+}
+
+func newProvisioningServer(t *testing.T) (*Server, *blockingEngine, string) {
+	t.Helper()
+	dir := t.TempDir()
+	sparse, err := engine.NewSparseFile(map[string]string{"dir": dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &blockingEngine{StorageEngine: sparse}
+	s := NewServer(db.NewMemoryDatabase(), log.New(io.Discard, "", 0))
+	s.UseEngine(e)
+	return s, e, dir
+}
+
+const volumeBody = `{"id": "vol1", "name": "pvc-1", "hostport": "192.168.0.107:4420", "size": "4M"}`
+
+func postVolume(s *Server, ctx context.Context) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/volumes", strings.NewReader(volumeBody)).WithContext(ctx)
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func getVolumeByName(t *testing.T, s *Server, name string) (model.Volume, int) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/volumes?name="+name, nil))
+	var volume model.Volume
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &volume); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return volume, w.Code
+}
+
+func TestAddVolumeProvisioning(t *testing.T) {
+	s, e, _ := newProvisioningServer(t)
+	e.started = make(chan struct{})
+	e.release = make(chan struct{})
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- postVolume(s, context.Background()) }()
+
+	<-e.started
+	volume, code := getVolumeByName(t, s, "pvc-1")
+	if code != http.StatusOK || !volume.Provisioning {
+		t.Errorf("volume while creating it = %d %+v, want it provisioning", code, volume)
+	}
+	// A second attempt doesn't start over while the first is running.
+	if w := postVolume(s, context.Background()); w.Code != http.StatusConflict {
+		t.Errorf("concurrent POST = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	close(e.release)
+	if w := <-done; w.Code != http.StatusCreated || strings.Contains(w.Body.String(), "provisioning") {
+		t.Errorf("POST = %d %s, want a provisioned volume", w.Code, w.Body)
+	}
+	volume, _ = getVolumeByName(t, s, "pvc-1")
+	if volume.Provisioning || volume.Path == "" {
+		t.Errorf("volume after creating it = %+v, want it provisioned", volume)
+	}
+}
+
+func TestAddVolumeOutlivesRequest(t *testing.T) {
+	s, e, _ := newProvisioningServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if w := postVolume(s, ctx); w.Code != http.StatusCreated {
+		t.Fatalf("POST = %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	if err := e.createCtx.Err(); err != nil {
+		t.Errorf("engine ran with a cancelled context: %v", err)
+	}
+}
+
+func TestAddVolumeFailureCleanup(t *testing.T) {
+	s, e, dir := newProvisioningServer(t)
+	e.exportErr = errors.New("export failed")
+	if w := postVolume(s, context.Background()); w.Code != http.StatusInternalServerError {
+		t.Fatalf("POST = %d %s, want %d", w.Code, w.Body, http.StatusInternalServerError)
+	}
+	if _, code := getVolumeByName(t, s, "pvc-1"); code != http.StatusNotFound {
+		t.Errorf("volume lookup after a failed POST = %d, want %d", code, http.StatusNotFound)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "vol1.img")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("space of the failed volume left behind: %v", err)
+	}
+}
+
+func TestAddVolumeLeftoverSpace(t *testing.T) {
+	s, e, dir := newProvisioningServer(t)
+	// An earlier attempt's cleanup failed, leaving space without a record.
+	if err := e.StorageEngine.Create(context.Background(), "vol1", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if w := postVolume(s, context.Background()); w.Code != http.StatusCreated {
+		t.Fatalf("POST = %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	info, err := os.Stat(filepath.Join(dir, "vol1.img"))
+	if err != nil || info.Size() != 4<<20 {
+		t.Errorf("volume file = %v, %v, want it recreated at %d bytes", info, err, 4<<20)
+	}
+}
+
+func TestAbandonProvisioning(t *testing.T) {
+	s, e, dir := newProvisioningServer(t)
+	ctx := context.Background()
+	for _, volume := range []model.Volume{
+		{ID: "vol1", Name: "pvc-1", Provisioning: true},
+		{ID: "vol2", Name: "pvc-2"},
+	} {
+		if err := s.db.AddVolume(volume); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Create(ctx, volume.ID, 1<<20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AbandonProvisioning(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.GetVolumeByID("vol1"); !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("provisioning volume kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "vol1.img")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("space of the provisioning volume kept: %v", err)
+	}
+	if _, err := s.db.GetVolumeByID("vol2"); err != nil {
+		t.Errorf("provisioned volume removed: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"example.com/csiproject/backend/internal/db"
+	"example.com/csiproject/backend/internal/engine"
+	"example.com/csiproject/backend/model"
+)
+
+func (s *Server) getSnapshots(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := s.db.GetSnapshots()
+	if err != nil {
+		s.log.Printf("error fetching snapshots: %v", err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, snapshots)
+}
+
+func (s *Server) getVolumeSnapshots(w http.ResponseWriter, r *http.Request, volumeID string) {
+	if !s.volumeExists(w, volumeID) {
+		return
+	}
+	all, err := s.db.GetSnapshots()
+	if err != nil {
+		s.log.Printf("error fetching snapshots: %v", err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	snapshots := make([]model.Snapshot, 0)
+	for _, snapshot := range all {
+		if snapshot.SourceVolumeID == volumeID {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	s.writeJSON(w, http.StatusOK, snapshots)
+}
+
+func (s *Server) getSnapshotByID(w http.ResponseWriter, r *http.Request, id string) {
+	snapshot, err := s.db.GetSnapshotByID(id)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.log.Printf("error fetching snapshot ID %q: %v", id, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, snapshot)
+}
+
+func (s *Server) getSnapshotByName(w http.ResponseWriter, r *http.Request, name string) {
+	snapshot, err := s.db.GetSnapshotByName(name)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.log.Printf("error fetching snapshot name %q: %v", name, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, snapshot)
+}
+
+// addSnapshot takes a snapshot of the volume. The request carries the new
+// snapshot's ID and name; the rest is filled in by the backend.
+func (s *Server) addSnapshot(w http.ResponseWriter, r *http.Request, volumeID string) {
+	var snapshot model.Snapshot
+	if !s.readJSON(w, r, &snapshot) {
+		return
+	}
+
+	type validationIssue struct {
+		Error   string `json:"error"`
+		Message string `json:"message,omitempty"`
+	}
+	issues := make(map[string]interface{})
+	if snapshot.ID == "" {
+		issues["id"] = validationIssue{"required", ""}
+	}
+	if snapshot.Name == "" {
+		issues["name"] = validationIssue{"required", ""}
+	}
+	if len(issues) > 0 {
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
+		return
+	}
+
+	volume, err := s.db.GetVolumeByID(volumeID)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.log.Printf("error fetching volume ID %q: %v", volumeID, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	// Check for clashes up front, before the engine does any work.
+	_, errID := s.db.GetSnapshotByID(snapshot.ID)
+	_, errName := s.db.GetSnapshotByName(snapshot.Name)
+	for _, err := range []error{errID, errName} {
+		if err == nil {
+			s.jsonError(w, http.StatusConflict, ErrorAlreadyExists, nil)
+			return
+		} else if !errors.Is(err, db.ErrDoesNotExist) {
+			s.log.Printf("error fetching snapshot %q: %v", snapshot.Name, err)
+			s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+			return
+		}
+	}
+
+	snapshot.SourceVolumeID = volume.ID
+	snapshot.SizeBytes = volume.CapacityBytes
+	snapshot.CreationTime = time.Now().UTC()
+	if s.engine != nil {
+		size, err := s.engine.Snapshot(r.Context(), volume.ID, snapshot.ID)
+		if errors.Is(err, engine.ErrAlreadyExists) {
+			s.jsonError(w, http.StatusConflict, ErrorAlreadyExists, nil)
+			return
+		} else if err != nil {
+			s.log.Printf("error taking snapshot %q of volume ID %q: %v", snapshot.ID, volume.ID, err)
+			s.jsonError(w, http.StatusInternalServerError, ErrorEngine, nil)
+			return
+		}
+		snapshot.SizeBytes = size
+	}
+	// Engines take snapshots synchronously, so they are ready right away.
+	snapshot.ReadyToUse = true
+
+	err = s.db.AddSnapshot(snapshot)
+	if err != nil {
+		// The engine snapshot is this request's own, since the engine
+		// refuses to take a second one with the same ID.
+		if s.engine != nil {
+			if err := s.engine.DeleteSnapshot(r.Context(), snapshot.ID); err != nil {
+				s.log.Printf("error cleaning up snapshot ID %q: %v", snapshot.ID, err)
+			}
+		}
+		if errors.Is(err, db.ErrAlreadyExists) {
+			s.jsonError(w, http.StatusConflict, ErrorAlreadyExists, nil)
+			return
+		}
+		s.log.Printf("error adding snapshot ID %q: %v", snapshot.ID, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+
+	s.writeJSON(w, http.StatusCreated, snapshot)
+}
+
+func (s *Server) deleteSnapshotByID(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := s.db.GetSnapshotByID(id); errors.Is(err, db.ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.log.Printf("error fetching snapshot ID %q: %v", id, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	// Keep the record until the space is freed, so a failed delete can be
+	// retried.
+	if s.engine != nil {
+		if err := s.engine.DeleteSnapshot(r.Context(), id); err != nil {
+			s.log.Printf("error deleting snapshot ID %q: %v", id, err)
+			s.jsonError(w, http.StatusInternalServerError, ErrorEngine, nil)
+			return
+		}
+	}
+	err := s.db.DeleteSnapshotByID(id)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.log.Printf("error deleting snapshot ID %q: %v", id, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, db.DeleteResponse{ID: id})
+}
+
+// volumeExists reports whether the volume exists, writing the error
+// response when it doesn't.
+func (s *Server) volumeExists(w http.ResponseWriter, id string) bool {
+	_, err := s.db.GetVolumeByID(id)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return false
+	} else if err != nil {
+		s.log.Printf("error fetching volume ID %q: %v", id, err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"errors"
+	"strings"
+
+	"example.com/csiproject/backend/internal/nvmet"
+	"example.com/csiproject/backend/model"
+)
+
+// volumeNSID is the namespace ID each volume's data is exported as within
+// its own subsystem.
+const volumeNSID = 1
+
+// errNoSubsystem is returned for volumes recorded without a subsystem NQN,
+// which therefore can't be exported.
+var errNoSubsystem = errors.New("volume has no subsystem NQN")
+
+// validNQN reports whether nqn can name a subsystem: an NVMe qualified name
+// that is also a single configfs path element.
+func validNQN(nqn string) bool {
+	return strings.HasPrefix(nqn, "nqn.") && len(nqn) <= 223 && !strings.ContainsAny(nqn, "/\x00")
+}
+
+// UseTarget makes the server provision an nvmet target for every volume,
+// rather than only keeping records of them.
+func (s *Server) UseTarget(target *nvmet.Target) {
+	s.target = target
+}
+
+// exportVolume makes the target match the volume: its subsystem exists with
+// the volume's namespace and allowed hosts, and is exported on the port the
+// volume's hostport names. It is safe to call again for the same volume.
+func (s *Server) exportVolume(volume model.Volume) error {
+	if s.target == nil {
+		return nil
+	}
+	nqn := volume.SubsystemNQN
+	if nqn == "" {
+		return errNoSubsystem
+	}
+	if err := s.target.CreateSubsystem(nqn); err != nil {
+		return err
+	}
+	// Volumes without a device, like the seeded test volumes, only get an
+	// empty subsystem.
+	if volume.Path != "" {
+		err := s.target.SetNamespace(nqn, nvmet.Namespace{
+			NSID:       volumeNSID,
+			DevicePath: volume.Path,
+			UUID:       volume.NamespaceUUID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.target.SetAllowedHosts(nqn, volume.AllowedHosts); err != nil {
+		return err
+	}
+	port, err := s.target.EnsurePort(volumePort(volume))
+	if err != nil {
+		return err
+	}
+	return s.target.ExportSubsystem(port.ID, nqn)
+}
+
+// revalidateVolume has the target pick up a new size of the volume's device
+// and announce it to the hosts connected to the volume's subsystem.
+func (s *Server) revalidateVolume(volume model.Volume) error {
+	if s.target == nil || volume.Path == "" || volume.SubsystemNQN == "" {
+		return nil
+	}
+	err := s.target.RevalidateNamespace(volume.SubsystemNQN, volumeNSID)
+	if err == nvmet.ErrNotFound {
+		// Not exported, so no host can have seen the old size.
+		return nil
+	}
+	return err
+}
+
+// unexportVolume tears down the volume's subsystem, along with its port if
+// nothing else is exported there. Unexporting a volume that was never
+// exported succeeds.
+func (s *Server) unexportVolume(volume model.Volume) error {
+	// A volume without a subsystem NQN was never exported.
+	if s.target == nil || volume.SubsystemNQN == "" {
+		return nil
+	}
+	if err := s.target.DeleteSubsystem(volume.SubsystemNQN); err != nil {
+		return err
+	}
+	want := volumePort(volume)
+	ports, err := s.target.Ports()
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		if p.Transport != want.Transport || p.Address != want.Address || p.ServiceID != want.ServiceID {
+			continue
+		}
+		nqns, err := s.target.PortSubsystems(p.ID)
+		if err != nil {
+			return err
+		}
+		if len(nqns) == 0 {
+			return s.target.RemovePort(p.ID)
+		}
+	}
+	return nil
+}
+
+// volumePort is the port the volume is exported on, as given by its context.
+func volumePort(volume model.Volume) nvmet.Port {
+	return nvmet.Port{
+		Transport: volume.Context[model.ContextTransport],
+		Address:   volume.Context[model.ContextAddress],
+		ServiceID: volume.Context[model.ContextPort],
+	}
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"example.com/csiproject/backend/model"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// volumesBucket maps volume IDs to JSON encoded volumes.
+	volumesBucket = []byte("volumes")
+	// volumeNamesBucket indexes volume IDs by volume name.
+	volumeNamesBucket = []byte("volume-names")
+	// snapshotsBucket maps snapshot IDs to JSON encoded snapshots.
+	snapshotsBucket = []byte("snapshots")
+	// snapshotNamesBucket indexes snapshot IDs by snapshot name.
+	snapshotNamesBucket = []byte("snapshot-names")
+)
+
+// BoltDatabase is a Database implementation that stores the volumes in a
+// bbolt file on disk. Every write is a transaction that is synced before it
+// returns, so the records survive a crash or restart of the backend.
+type BoltDatabase struct {
+	db *bolt.DB
+}
+
+// NewBoltDatabase opens, or creates, the database file at path.
+func NewBoltDatabase(path string) (*BoltDatabase, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{volumesBucket, volumeNamesBucket, snapshotsBucket, snapshotNamesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDatabase{db: db}, nil
+}
+
+// Close closes the database file.
+func (d *BoltDatabase) Close() error {
+	return d.db.Close()
+}
+
+func (d *BoltDatabase) GetVolumes() ([]model.Volume, error) {
+	volumes := make([]model.Volume, 0)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		// Keys are kept in byte order, so this is already sorted by ID.
+		return tx.Bucket(volumesBucket).ForEach(func(_, v []byte) error {
+			var volume model.Volume
+			if err := json.Unmarshal(v, &volume); err != nil {
+				return err
+			}
+			volumes = append(volumes, volume)
+			return nil
+		})
+	})
+	return volumes, err
+}
+
+func (d *BoltDatabase) GetVolumeByID(id string) (model.Volume, error) {
+	var volume model.Volume
+	err := d.db.View(func(tx *bolt.Tx) error {
+		var err error
+		volume, err = getVolume(tx, id)
+		return err
+	})
+	return volume, err
+}
+
+func (d *BoltDatabase) GetVolumeByName(name string) (model.Volume, error) {
+	var volume model.Volume
+	err := d.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(volumeNamesBucket).Get([]byte(name))
+		if id == nil {
+			return ErrDoesNotExist
+		}
+		var err error
+		volume, err = getVolume(tx, string(id))
+		return err
+	})
+	return volume, err
+}
+
+func (d *BoltDatabase) AddVolume(volume model.Volume) error {
+	b, err := json.Marshal(volume)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		volumes := tx.Bucket(volumesBucket)
+		names := tx.Bucket(volumeNamesBucket)
+		if volumes.Get([]byte(volume.ID)) != nil || names.Get([]byte(volume.Name)) != nil {
+			return ErrAlreadyExists
+		}
+		if err := volumes.Put([]byte(volume.ID), b); err != nil {
+			return err
+		}
+		return names.Put([]byte(volume.Name), []byte(volume.ID))
+	})
+}
+
+func (d *BoltDatabase) UpdateVolume(id string, update func(*model.Volume) error) (model.Volume, error) {
+	var updated model.Volume
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		volume, err := getVolume(tx, id)
+		if err != nil {
+			return err
+		}
+		name := volume.Name
+		if err := update(&volume); err != nil {
+			return err
+		}
+		volume.ID, volume.Name = id, name
+		b, err := json.Marshal(volume)
+		if err != nil {
+			return err
+		}
+		updated = volume
+		return tx.Bucket(volumesBucket).Put([]byte(id), b)
+	})
+	if err != nil {
+		return model.Volume{}, err
+	}
+	return updated, nil
+}
+
+func (d *BoltDatabase) DeleteVolumeByID(id string) (DeleteResponse, error) {
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		volume, err := getVolume(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(volumeNamesBucket).Delete([]byte(volume.Name)); err != nil {
+			return err
+		}
+		return tx.Bucket(volumesBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return DeleteResponse{}, err
+	}
+	return DeleteResponse{ID: id}, nil
+}
+
+func (d *BoltDatabase) GetSnapshots() ([]model.Snapshot, error) {
+	snapshots := make([]model.Snapshot, 0)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotsBucket).ForEach(func(_, v []byte) error {
+			var snapshot model.Snapshot
+			if err := json.Unmarshal(v, &snapshot); err != nil {
+				return err
+			}
+			snapshots = append(snapshots, snapshot)
+			return nil
+		})
+	})
+	return snapshots, err
+}
+
+func (d *BoltDatabase) GetSnapshotByID(id string) (model.Snapshot, error) {
+	var snapshot model.Snapshot
+	err := d.db.View(func(tx *bolt.Tx) error {
+		var err error
+		snapshot, err = getSnapshot(tx, id)
+		return err
+	})
+	return snapshot, err
+}
+
+func (d *BoltDatabase) GetSnapshotByName(name string) (model.Snapshot, error) {
+	var snapshot model.Snapshot
+	err := d.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(snapshotNamesBucket).Get([]byte(name))
+		if id == nil {
+			return ErrDoesNotExist
+		}
+		var err error
+		snapshot, err = getSnapshot(tx, string(id))
+		return err
+	})
+	return snapshot, err
+}
+
+func (d *BoltDatabase) AddSnapshot(snapshot model.Snapshot) error {
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		snapshots := tx.Bucket(snapshotsBucket)
+		names := tx.Bucket(snapshotNamesBucket)
+		if snapshots.Get([]byte(snapshot.ID)) != nil || names.Get([]byte(snapshot.Name)) != nil {
+			return ErrAlreadyExists
+		}
+		if err := snapshots.Put([]byte(snapshot.ID), b); err != nil {
+			return err
+		}
+		return names.Put([]byte(snapshot.Name), []byte(snapshot.ID))
+	})
+}
+
+func (d *BoltDatabase) DeleteSnapshotByID(id string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		snapshot, err := getSnapshot(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(snapshotNamesBucket).Delete([]byte(snapshot.Name)); err != nil {
+			return err
+		}
+		return tx.Bucket(snapshotsBucket).Delete([]byte(id))
+	})
+}
+
+// getVolume loads a single volume within a transaction.
+func getVolume(tx *bolt.Tx, id string) (model.Volume, error) {
+	var volume model.Volume
+	b := tx.Bucket(volumesBucket).Get([]byte(id))
+	if b == nil {
+		return volume, ErrDoesNotExist
+	}
+	err := json.Unmarshal(b, &volume)
+	return volume, err
+}
+
+// getSnapshot loads a single snapshot within a transaction.
+func getSnapshot(tx *bolt.Tx, id string) (model.Snapshot, error) {
+	var snapshot model.Snapshot
+	b := tx.Bucket(snapshotsBucket).Get([]byte(id))
+	if b == nil {
+		return snapshot, ErrDoesNotExist
+	}
+	err := json.Unmarshal(b, &snapshot)
+	return snapshot, err
+}
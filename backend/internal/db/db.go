@@ -2,6 +2,8 @@ package db
 
 import (
 	"errors"
+	"maps"
+	"slices"
 	"sort"
 	"sync"
 
@@ -26,25 +28,58 @@ type Database interface {
 	// an volume with that ID does not exist.
 	GetVolumeByID(id string) (model.Volume, error)
 
+	// GetVolumeByName returns a single volume by name, or ErrDoesNotExist if
+	// a volume with that name does not exist.
+	GetVolumeByName(name string) (model.Volume, error)
+
 	// DeleteVolumesByID returns ErrDoesNotExist if
 	// an volume with that ID does not exist, otherwise deletes the volume entry.
 	DeleteVolumeByID(id string) (DeleteResponse, error)
 
 	// AddVolume adds a single volume, or ErrAlreadyExists if an volume with
-	// the given ID already exists.
+	// the given ID or name already exists.
 	AddVolume(volume model.Volume) error
+
+	// UpdateVolume atomically applies update to the volume with the given
+	// ID and stores the result, which it also returns. It returns
+	// ErrDoesNotExist if there is no such volume, and stores nothing if
+	// update returns an error. Changes to the ID or name are discarded.
+	UpdateVolume(id string, update func(*model.Volume) error) (model.Volume, error)
+
+	// GetSnapshots returns all snapshots, sorted by ID.
+	GetSnapshots() ([]model.Snapshot, error)
+
+	// GetSnapshotByID returns a single snapshot by ID, or ErrDoesNotExist if
+	// a snapshot with that ID does not exist.
+	GetSnapshotByID(id string) (model.Snapshot, error)
+
+	// GetSnapshotByName returns a single snapshot by name, or
+	// ErrDoesNotExist if a snapshot with that name does not exist.
+	GetSnapshotByName(name string) (model.Snapshot, error)
+
+	// AddSnapshot adds a single snapshot, or ErrAlreadyExists if a snapshot
+	// with the given ID or name already exists.
+	AddSnapshot(snapshot model.Snapshot) error
+
+	// DeleteSnapshotByID deletes a snapshot, or returns ErrDoesNotExist if a
+	// snapshot with that ID does not exist.
+	DeleteSnapshotByID(id string) error
 }
 
 // MemoryDatabase is a Database implementation that uses a simple
 // in-memory map to store the volumes.
 type MemoryDatabase struct {
-	lock    sync.RWMutex
-	volumes map[string]model.Volume
+	lock      sync.RWMutex
+	volumes   map[string]model.Volume
+	snapshots map[string]model.Snapshot
 }
 
 // NewMemoryDatabase creates a new in-memory database.
 func NewMemoryDatabase() *MemoryDatabase {
-	return &MemoryDatabase{volumes: make(map[string]model.Volume)}
+	return &MemoryDatabase{
+		volumes:   make(map[string]model.Volume),
+		snapshots: make(map[string]model.Snapshot),
+	}
 }
 
 func (d *MemoryDatabase) GetVolumes() ([]model.Volume, error) {
@@ -54,7 +89,7 @@ func (d *MemoryDatabase) GetVolumes() ([]model.Volume, error) {
 	// Make a copy of the volumes map (as a slice)
 	volumes := make([]model.Volume, 0, len(d.volumes))
 	for _, volume := range d.volumes {
-		volumes = append(volumes, volume)
+		volumes = append(volumes, cloneVolume(volume))
 	}
 
 	// Sort by ID so we return them in a defined order
@@ -72,7 +107,19 @@ func (d *MemoryDatabase) GetVolumeByID(id string) (model.Volume, error) {
 	if !ok {
 		return model.Volume{}, ErrDoesNotExist
 	}
-	return volume, nil
+	return cloneVolume(volume), nil
+}
+
+func (d *MemoryDatabase) GetVolumeByName(name string) (model.Volume, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	for _, volume := range d.volumes {
+		if volume.Name == name {
+			return cloneVolume(volume), nil
+		}
+	}
+	return model.Volume{}, ErrDoesNotExist
 }
 
 func (d *MemoryDatabase) AddVolume(volume model.Volume) error {
@@ -82,13 +129,35 @@ func (d *MemoryDatabase) AddVolume(volume model.Volume) error {
 	if _, ok := d.volumes[volume.ID]; ok {
 		return ErrAlreadyExists
 	}
-	d.volumes[volume.ID] = volume
+	for _, v := range d.volumes {
+		if v.Name == volume.Name {
+			return ErrAlreadyExists
+		}
+	}
+	d.volumes[volume.ID] = cloneVolume(volume)
 	return nil
 }
 
+func (d *MemoryDatabase) UpdateVolume(id string, update func(*model.Volume) error) (model.Volume, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	volume, ok := d.volumes[id]
+	if !ok {
+		return model.Volume{}, ErrDoesNotExist
+	}
+	updated := cloneVolume(volume)
+	if err := update(&updated); err != nil {
+		return model.Volume{}, err
+	}
+	updated.ID, updated.Name = volume.ID, volume.Name
+	d.volumes[id] = cloneVolume(updated)
+	return updated, nil
+}
+
 func (d *MemoryDatabase) DeleteVolumeByID(id string) (DeleteResponse, error) {
-	d.lock.RLock()
-	defer d.lock.RUnlock()
+	d.lock.Lock()
+	defer d.lock.Unlock()
 
 	_, ok := d.volumes[id]
 	if !ok {
@@ -97,3 +166,76 @@ func (d *MemoryDatabase) DeleteVolumeByID(id string) (DeleteResponse, error) {
 	delete(d.volumes, id)
 	return DeleteResponse{ID: id}, nil
 }
+
+func (d *MemoryDatabase) GetSnapshots() ([]model.Snapshot, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	snapshots := make([]model.Snapshot, 0, len(d.snapshots))
+	for _, snapshot := range d.snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ID < snapshots[j].ID
+	})
+	return snapshots, nil
+}
+
+func (d *MemoryDatabase) GetSnapshotByID(id string) (model.Snapshot, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	snapshot, ok := d.snapshots[id]
+	if !ok {
+		return model.Snapshot{}, ErrDoesNotExist
+	}
+	return snapshot, nil
+}
+
+func (d *MemoryDatabase) GetSnapshotByName(name string) (model.Snapshot, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	for _, snapshot := range d.snapshots {
+		if snapshot.Name == name {
+			return snapshot, nil
+		}
+	}
+	return model.Snapshot{}, ErrDoesNotExist
+}
+
+func (d *MemoryDatabase) AddSnapshot(snapshot model.Snapshot) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.snapshots[snapshot.ID]; ok {
+		return ErrAlreadyExists
+	}
+	for _, s := range d.snapshots {
+		if s.Name == snapshot.Name {
+			return ErrAlreadyExists
+		}
+	}
+	d.snapshots[snapshot.ID] = snapshot
+	return nil
+}
+
+func (d *MemoryDatabase) DeleteSnapshotByID(id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.snapshots[id]; !ok {
+		return ErrDoesNotExist
+	}
+	delete(d.snapshots, id)
+	return nil
+}
+
+// cloneVolume returns a copy of volume that shares no maps with it, so
+// callers can't modify the stored volumes behind the lock's back.
+func cloneVolume(volume model.Volume) model.Volume {
+	volume.Parameters = maps.Clone(volume.Parameters)
+	volume.Context = maps.Clone(volume.Context)
+	volume.AllowedHosts = slices.Clone(volume.AllowedHosts)
+	return volume
+}
@@ -0,0 +1,85 @@
+package db_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"example.com/csiproject/backend/internal/db"
+	"example.com/csiproject/backend/internal/db/dbtest"
+	"example.com/csiproject/backend/model"
+)
+
+func TestMemoryDatabase(t *testing.T) {
+	dbtest.TestDatabase(t, func(t *testing.T) db.Database {
+		return db.NewMemoryDatabase()
+	})
+}
+
+func TestBoltDatabase(t *testing.T) {
+	dbtest.TestDatabase(t, func(t *testing.T) db.Database {
+		return openBolt(t, filepath.Join(t.TempDir(), "db"))
+	})
+}
+
+// TestBoltDatabaseReopen checks that records written before the file is
+// closed are all there when it is opened again, as after a restart.
+func TestBoltDatabaseReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	volumes := []model.Volume{
+		{ID: "1", Name: "pvc-1", Size: "1G", CapacityBytes: 1 << 30, AllowedHosts: []string{"nqn.2014-08.org.nvmexpress:uuid:1"}},
+		{ID: "2", Name: "pvc-2", Size: "2G", CapacityBytes: 2 << 30, Parameters: map[string]string{"fstype": "xfs"}},
+	}
+	snapshot := model.Snapshot{
+		ID:             "s1",
+		Name:           "snapshot-1",
+		SourceVolumeID: "1",
+		SizeBytes:      1 << 30,
+		CreationTime:   time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC),
+		ReadyToUse:     true,
+	}
+
+	d := openBolt(t, path)
+	for _, v := range volumes {
+		if err := d.AddVolume(v); err != nil {
+			t.Fatalf("AddVolume(%q): %v", v.ID, err)
+		}
+	}
+	if err := d.AddSnapshot(snapshot); err != nil {
+		t.Fatalf("AddSnapshot: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	d = openBolt(t, path)
+	got, err := d.GetVolumes()
+	if err != nil {
+		t.Fatalf("GetVolumes: %v", err)
+	}
+	if !reflect.DeepEqual(got, volumes) {
+		t.Errorf("GetVolumes after reopening = %+v, want %+v", got, volumes)
+	}
+	byName, err := d.GetVolumeByName("pvc-2")
+	if err != nil || byName.ID != "2" {
+		t.Errorf("GetVolumeByName(pvc-2) after reopening = %+v, %v, want volume 2", byName, err)
+	}
+	gotSnapshot, err := d.GetSnapshotByName("snapshot-1")
+	if err != nil {
+		t.Fatalf("GetSnapshotByName after reopening: %v", err)
+	}
+	if !reflect.DeepEqual(gotSnapshot, snapshot) {
+		t.Errorf("GetSnapshotByName after reopening = %+v, want %+v", gotSnapshot, snapshot)
+	}
+}
+
+func openBolt(t *testing.T, path string) *db.BoltDatabase {
+	t.Helper()
+	d, err := db.NewBoltDatabase(path)
+	if err != nil {
+		t.Fatalf("NewBoltDatabase: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
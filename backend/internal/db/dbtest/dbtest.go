@@ -0,0 +1,510 @@
+// Package dbtest implements a conformance suite for db.Database
+// implementations.
+//
+// A store runs it from its own tests, ideally under -race:
+//
+//	func TestBoltDatabase(t *testing.T) {
+//		dbtest.TestDatabase(t, func(t *testing.T) db.Database {
+//			d, err := db.NewBoltDatabase(filepath.Join(t.TempDir(), "volumes.db"))
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			t.Cleanup(func() { d.Close() })
+//			return d
+//		})
+//	}
+package dbtest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"example.com/csiproject/backend/internal/db"
+	"example.com/csiproject/backend/model"
+)
+
+// TestDatabase runs the conformance suite. newDatabase must return a new,
+// empty database each time it is called.
+func TestDatabase(t *testing.T, newDatabase func(t *testing.T) db.Database) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, d db.Database)
+	}{
+		{"Empty", testEmpty},
+		{"AddAndGet", testAddAndGet},
+		{"AddDuplicate", testAddDuplicate},
+		{"GetMissing", testGetMissing},
+		{"Delete", testDelete},
+		{"Ordering", testOrdering},
+		{"Copies", testCopies},
+		{"Update", testUpdate},
+		{"UpdateMissing", testUpdateMissing},
+		{"UpdateError", testUpdateError},
+		{"ParallelDistinct", testParallelDistinct},
+		{"ParallelSameVolume", testParallelSameVolume},
+		{"ParallelUpdate", testParallelUpdate},
+		{"Snapshots", testSnapshots},
+		{"SnapshotDuplicate", testSnapshotDuplicate},
+		{"SnapshotDelete", testSnapshotDelete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newDatabase(t))
+		})
+	}
+}
+
+func volume(id string) model.Volume {
+	return model.Volume{
+		ID:            id,
+		Name:          "pvc-" + id,
+		Path:          "/dev/vg/" + id,
+		Size:          "1G",
+		Hostport:      "192.168.0.107:4420",
+		CapacityBytes: 1 << 30,
+		Parameters:    map[string]string{"fstype": "xfs"},
+		Context:       map[string]string{"hostport": "192.168.0.107:4420"},
+	}
+}
+
+func snapshot(id, volumeID string) model.Snapshot {
+	return model.Snapshot{
+		ID:             id,
+		Name:           "snapshot-" + id,
+		SourceVolumeID: volumeID,
+		SizeBytes:      1 << 30,
+		CreationTime:   time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC),
+		ReadyToUse:     true,
+	}
+}
+
+func mustAdd(t *testing.T, d db.Database, volumes ...model.Volume) {
+	t.Helper()
+	for _, v := range volumes {
+		if err := d.AddVolume(v); err != nil {
+			t.Fatalf("AddVolume(%q): %v", v.ID, err)
+		}
+	}
+}
+
+func testEmpty(t *testing.T, d db.Database) {
+	volumes, err := d.GetVolumes()
+	if err != nil {
+		t.Fatalf("GetVolumes: %v", err)
+	}
+	if volumes == nil || len(volumes) != 0 {
+		t.Fatalf("GetVolumes = %#v, want an empty non-nil slice", volumes)
+	}
+}
+
+func testAddAndGet(t *testing.T, d db.Database) {
+	want := volume("1")
+	mustAdd(t, d, want)
+
+	got, err := d.GetVolumeByID("1")
+	if err != nil {
+		t.Fatalf("GetVolumeByID: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetVolumeByID = %+v, want %+v", got, want)
+	}
+
+	got, err = d.GetVolumeByName(want.Name)
+	if err != nil {
+		t.Fatalf("GetVolumeByName: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetVolumeByName = %+v, want %+v", got, want)
+	}
+}
+
+func testAddDuplicate(t *testing.T, d db.Database) {
+	mustAdd(t, d, volume("1"))
+
+	sameID := volume("1")
+	sameID.Name = "other"
+	if err := d.AddVolume(sameID); !errors.Is(err, db.ErrAlreadyExists) {
+		t.Errorf("AddVolume with a duplicate ID = %v, want ErrAlreadyExists", err)
+	}
+
+	sameName := volume("2")
+	sameName.Name = volume("1").Name
+	if err := d.AddVolume(sameName); !errors.Is(err, db.ErrAlreadyExists) {
+		t.Errorf("AddVolume with a duplicate name = %v, want ErrAlreadyExists", err)
+	}
+
+	volumes, err := d.GetVolumes()
+	if err != nil {
+		t.Fatalf("GetVolumes: %v", err)
+	}
+	if len(volumes) != 1 || !reflect.DeepEqual(volumes[0], volume("1")) {
+		t.Errorf("GetVolumes after rejected adds = %+v, want only volume 1", volumes)
+	}
+}
+
+func testGetMissing(t *testing.T, d db.Database) {
+	mustAdd(t, d, volume("1"))
+
+	if _, err := d.GetVolumeByID("2"); !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("GetVolumeByID of a missing volume = %v, want ErrDoesNotExist", err)
+	}
+	if _, err := d.GetVolumeByName("pvc-2"); !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("GetVolumeByName of a missing volume = %v, want ErrDoesNotExist", err)
+	}
+}
+
+func testDelete(t *testing.T, d db.Database) {
+	mustAdd(t, d, volume("1"), volume("2"))
+
+	resp, err := d.DeleteVolumeByID("1")
+	if err != nil {
+		t.Fatalf("DeleteVolumeByID: %v", err)
+	}
+	if resp.ID != "1" {
+		t.Errorf("DeleteVolumeByID response ID = %q, want %q", resp.ID, "1")
+	}
+	if _, err := d.DeleteVolumeByID("1"); !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("second DeleteVolumeByID = %v, want ErrDoesNotExist", err)
+	}
+	if _, err := d.GetVolumeByID("1"); !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("GetVolumeByID after delete = %v, want ErrDoesNotExist", err)
+	}
+	if _, err := d.GetVolumeByName("pvc-1"); !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("GetVolumeByName after delete = %v, want ErrDoesNotExist", err)
+	}
+	if _, err := d.GetVolumeByID("2"); err != nil {
+		t.Errorf("GetVolumeByID of the other volume after delete: %v", err)
+	}
+
+	// Both the ID and the name are free again.
+	mustAdd(t, d, volume("1"))
+}
+
+func testOrdering(t *testing.T, d db.Database) {
+	ids := []string{"b", "10", "a", "2", "1"}
+	for _, id := range ids {
+		mustAdd(t, d, volume(id))
+	}
+	sort.Strings(ids)
+
+	volumes, err := d.GetVolumes()
+	if err != nil {
+		t.Fatalf("GetVolumes: %v", err)
+	}
+	var got []string
+	for _, v := range volumes {
+		got = append(got, v.ID)
+	}
+	if !reflect.DeepEqual(got, ids) {
+		t.Errorf("GetVolumes IDs = %v, want %v", got, ids)
+	}
+}
+
+func testCopies(t *testing.T, d db.Database) {
+	added := volume("1")
+	mustAdd(t, d, added)
+	added.Parameters["fstype"] = "changed"
+
+	got, err := d.GetVolumeByID("1")
+	if err != nil {
+		t.Fatalf("GetVolumeByID: %v", err)
+	}
+	got.Context["hostport"] = "changed"
+
+	volumes, err := d.GetVolumes()
+	if err != nil {
+		t.Fatalf("GetVolumes: %v", err)
+	}
+	volumes[0].Name = "changed"
+	volumes[0].Parameters["fstype"] = "changed"
+
+	got, err = d.GetVolumeByID("1")
+	if err != nil {
+		t.Fatalf("GetVolumeByID: %v", err)
+	}
+	if !reflect.DeepEqual(got, volume("1")) {
+		t.Errorf("stored volume changed through a returned value: %+v", got)
+	}
+}
+
+func testUpdate(t *testing.T, d db.Database) {
+	mustAdd(t, d, volume("1"), volume("2"))
+
+	want := volume("1")
+	want.AllowedHosts = []string{"nqn.2014-08.org.nvmexpress:uuid:a"}
+	got, err := d.UpdateVolume("1", func(v *model.Volume) error {
+		v.AllowedHosts = append(v.AllowedHosts, "nqn.2014-08.org.nvmexpress:uuid:a")
+		// Neither of these may stick.
+		v.ID = "other"
+		v.Name = "other"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateVolume: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UpdateVolume = %+v, want %+v", got, want)
+	}
+	got.AllowedHosts[0] = "changed"
+
+	if got, err := d.GetVolumeByName("pvc-1"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetVolumeByName after update = %+v, %v, want %+v", got, err, want)
+	}
+	if got, err := d.GetVolumeByID("2"); err != nil || !reflect.DeepEqual(got, volume("2")) {
+		t.Errorf("GetVolumeByID of the other volume after update = %+v, %v", got, err)
+	}
+	if _, err := d.GetVolumeByID("other"); !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("GetVolumeByID of the changed ID = %v, want ErrDoesNotExist", err)
+	}
+}
+
+func testUpdateMissing(t *testing.T, d db.Database) {
+	called := false
+	_, err := d.UpdateVolume("1", func(v *model.Volume) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("UpdateVolume of a missing volume = %v, want ErrDoesNotExist", err)
+	}
+	if called {
+		t.Errorf("UpdateVolume called update for a missing volume")
+	}
+}
+
+func testUpdateError(t *testing.T, d db.Database) {
+	mustAdd(t, d, volume("1"))
+
+	errUpdate := errors.New("update failed")
+	_, err := d.UpdateVolume("1", func(v *model.Volume) error {
+		v.Size = "2G"
+		return errUpdate
+	})
+	if !errors.Is(err, errUpdate) {
+		t.Errorf("UpdateVolume = %v, want the update's error", err)
+	}
+	if got, err := d.GetVolumeByID("1"); err != nil || !reflect.DeepEqual(got, volume("1")) {
+		t.Errorf("GetVolumeByID after a failed update = %+v, %v, want it unchanged", got, err)
+	}
+}
+
+// testParallelDistinct has many goroutines each add, read and delete their
+// own volumes while listing the whole database.
+func testParallelDistinct(t *testing.T, d db.Database) {
+	const workers, perWorker = 8, 24
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- func() error {
+				for i := 0; i < perWorker; i++ {
+					v := volume(fmt.Sprintf("%d-%d", w, i))
+					if err := d.AddVolume(v); err != nil {
+						return fmt.Errorf("AddVolume(%q): %v", v.ID, err)
+					}
+					if _, err := d.GetVolumeByName(v.Name); err != nil {
+						return fmt.Errorf("GetVolumeByName(%q): %v", v.Name, err)
+					}
+					if _, err := d.GetVolumes(); err != nil {
+						return fmt.Errorf("GetVolumes: %v", err)
+					}
+					// Delete every other volume so the end state is known.
+					if i%2 == 0 {
+						if _, err := d.DeleteVolumeByID(v.ID); err != nil {
+							return fmt.Errorf("DeleteVolumeByID(%q): %v", v.ID, err)
+						}
+					}
+				}
+				return nil
+			}()
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	volumes, err := d.GetVolumes()
+	if err != nil {
+		t.Fatalf("GetVolumes: %v", err)
+	}
+	if want := workers * perWorker / 2; len(volumes) != want {
+		t.Errorf("GetVolumes returned %d volumes, want %d", len(volumes), want)
+	}
+}
+
+// testParallelSameVolume races goroutines adding and deleting the same
+// volume: exactly one of each must win.
+func testParallelSameVolume(t *testing.T, d db.Database) {
+	const workers = 16
+
+	race := func(op func(i int) error, wantErr error) int32 {
+		var wins atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := op(i)
+				switch {
+				case err == nil:
+					wins.Add(1)
+				case !errors.Is(err, wantErr):
+					t.Errorf("unexpected error: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		return wins.Load()
+	}
+
+	// Same name under different IDs, as concurrent CreateVolume retries do.
+	added := race(func(i int) error {
+		v := volume(fmt.Sprint(i))
+		v.Name = "pvc-shared"
+		return d.AddVolume(v)
+	}, db.ErrAlreadyExists)
+	if added != 1 {
+		t.Fatalf("%d concurrent adds of the same name succeeded, want 1", added)
+	}
+
+	winner, err := d.GetVolumeByName("pvc-shared")
+	if err != nil {
+		t.Fatalf("GetVolumeByName: %v", err)
+	}
+	deleted := race(func(int) error {
+		_, err := d.DeleteVolumeByID(winner.ID)
+		return err
+	}, db.ErrDoesNotExist)
+	if deleted != 1 {
+		t.Errorf("%d concurrent deletes of the same volume succeeded, want 1", deleted)
+	}
+}
+
+// testParallelUpdate has goroutines append to the same volume at once: no
+// update may be lost.
+func testParallelUpdate(t *testing.T, d db.Database) {
+	const workers = 16
+	mustAdd(t, d, volume("1"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := d.UpdateVolume("1", func(v *model.Volume) error {
+				v.AllowedHosts = append(v.AllowedHosts, fmt.Sprint(i))
+				return nil
+			})
+			if err != nil {
+				t.Errorf("UpdateVolume: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got, err := d.GetVolumeByID("1")
+	if err != nil {
+		t.Fatalf("GetVolumeByID: %v", err)
+	}
+	if len(got.AllowedHosts) != workers {
+		t.Errorf("volume has %d hosts after %d concurrent updates: %v", len(got.AllowedHosts), workers, got.AllowedHosts)
+	}
+}
+
+func testSnapshots(t *testing.T, d db.Database) {
+	snapshots, err := d.GetSnapshots()
+	if err != nil {
+		t.Fatalf("GetSnapshots: %v", err)
+	}
+	if snapshots == nil || len(snapshots) != 0 {
+		t.Errorf("GetSnapshots on an empty database = %#v, want an empty non-nil slice", snapshots)
+	}
+
+	want := []model.Snapshot{snapshot("a", "1"), snapshot("b", "1"), snapshot("c", "2")}
+	for _, s := range []model.Snapshot{want[2], want[0], want[1]} {
+		if err := d.AddSnapshot(s); err != nil {
+			t.Fatalf("AddSnapshot(%q): %v", s.ID, err)
+		}
+	}
+
+	snapshots, err = d.GetSnapshots()
+	if err != nil {
+		t.Fatalf("GetSnapshots: %v", err)
+	}
+	if !reflect.DeepEqual(snapshots, want) {
+		t.Errorf("GetSnapshots = %+v, want %+v", snapshots, want)
+	}
+	if got, err := d.GetSnapshotByID("b"); err != nil || !reflect.DeepEqual(got, want[1]) {
+		t.Errorf("GetSnapshotByID = %+v, %v, want %+v", got, err, want[1])
+	}
+	if got, err := d.GetSnapshotByName("snapshot-c"); err != nil || !reflect.DeepEqual(got, want[2]) {
+		t.Errorf("GetSnapshotByName = %+v, %v, want %+v", got, err, want[2])
+	}
+	if _, err := d.GetSnapshotByID("d"); !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("GetSnapshotByID of a missing snapshot = %v, want ErrDoesNotExist", err)
+	}
+	if _, err := d.GetSnapshotByName("snapshot-d"); !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("GetSnapshotByName of a missing snapshot = %v, want ErrDoesNotExist", err)
+	}
+}
+
+func testSnapshotDuplicate(t *testing.T, d db.Database) {
+	if err := d.AddSnapshot(snapshot("a", "1")); err != nil {
+		t.Fatalf("AddSnapshot: %v", err)
+	}
+
+	sameID := snapshot("a", "2")
+	sameID.Name = "other"
+	if err := d.AddSnapshot(sameID); !errors.Is(err, db.ErrAlreadyExists) {
+		t.Errorf("AddSnapshot with a duplicate ID = %v, want ErrAlreadyExists", err)
+	}
+	sameName := snapshot("b", "1")
+	sameName.Name = snapshot("a", "1").Name
+	if err := d.AddSnapshot(sameName); !errors.Is(err, db.ErrAlreadyExists) {
+		t.Errorf("AddSnapshot with a duplicate name = %v, want ErrAlreadyExists", err)
+	}
+
+	// Volumes and snapshots don't share IDs or names.
+	v := volume("a")
+	v.Name = snapshot("a", "1").Name
+	mustAdd(t, d, v)
+}
+
+func testSnapshotDelete(t *testing.T, d db.Database) {
+	for _, s := range []model.Snapshot{snapshot("a", "1"), snapshot("b", "1")} {
+		if err := d.AddSnapshot(s); err != nil {
+			t.Fatalf("AddSnapshot(%q): %v", s.ID, err)
+		}
+	}
+
+	if err := d.DeleteSnapshotByID("a"); err != nil {
+		t.Fatalf("DeleteSnapshotByID: %v", err)
+	}
+	if err := d.DeleteSnapshotByID("a"); !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("second DeleteSnapshotByID = %v, want ErrDoesNotExist", err)
+	}
+	if _, err := d.GetSnapshotByName("snapshot-a"); !errors.Is(err, db.ErrDoesNotExist) {
+		t.Errorf("GetSnapshotByName after delete = %v, want ErrDoesNotExist", err)
+	}
+	if _, err := d.GetSnapshotByID("b"); err != nil {
+		t.Errorf("GetSnapshotByID of the other snapshot after delete: %v", err)
+	}
+
+	// Both the ID and the name are free again.
+	if err := d.AddSnapshot(snapshot("a", "1")); err != nil {
+		t.Errorf("AddSnapshot after delete: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+// Package engine defines where the bytes of the backend's volumes live.
+//
+// A StorageEngine allocates the space for volumes and snapshots and tells
+// the target which device or file to export for each. Engines are picked by
+// name from the backend config, so new ones only have to be registered
+// here, not wired into the HTTP layer.
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned for a volume or snapshot the engine doesn't
+	// have.
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists is returned when creating a volume or snapshot that
+	// already has space allocated.
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrNotSupported is returned by engines that can't perform an
+	// operation.
+	ErrNotSupported = errors.New("not supported")
+)
+
+// StorageEngine allocates and manages the space behind volumes. Volumes and
+// snapshots are identified by their backend IDs.
+type StorageEngine interface {
+	// Create allocates a new volume of sizeBytes, or returns
+	// ErrAlreadyExists.
+	Create(ctx context.Context, id string, sizeBytes int64) error
+
+	// Delete frees a volume. Deleting a missing volume succeeds.
+	Delete(ctx context.Context, id string) error
+
+	// Resize grows a volume to sizeBytes.
+	Resize(ctx context.Context, id string, sizeBytes int64) error
+
+	// Snapshot takes a point in time copy of a volume, returning the
+	// snapshot's size.
+	Snapshot(ctx context.Context, volumeID, snapshotID string) (int64, error)
+
+	// DeleteSnapshot frees a snapshot. Deleting a missing snapshot
+	// succeeds.
+	DeleteSnapshot(ctx context.Context, snapshotID string) error
+
+	// Clone creates a new volume of sizeBytes holding the contents of a
+	// snapshot or another volume. sizeBytes is at least the source's size.
+	Clone(ctx context.Context, id string, sizeBytes int64, source Source) error
+
+	// Usage reports how much space the engine has and uses.
+	Usage(ctx context.Context) (Usage, error)
+
+	// Export returns the block device or file the target should export
+	// the volume from.
+	Export(ctx context.Context, id string) (string, error)
+}
+
+// Source is what a cloned volume is created from; exactly one of the IDs is
+// set.
+type Source struct {
+	SnapshotID string
+	VolumeID   string
+}
+
+// Usage is how much space an engine has and uses. Fields an engine can't
+// tell are left zero.
+type Usage struct {
+	Engine string `json:"engine"`
+	// CapacityBytes is the space available to volumes and snapshots.
+	CapacityBytes int64 `json:"capacity_bytes,omitempty"`
+	// AllocatedBytes is the space actually in use, which for thin or sparse
+	// volumes is less than their combined size.
+	AllocatedBytes int64 `json:"allocated_bytes"`
+	// Metadata space, for engines that keep it apart from the data.
+	MetadataCapacityBytes  int64 `json:"metadata_capacity_bytes,omitempty"`
+	MetadataAllocatedBytes int64 `json:"metadata_allocated_bytes,omitempty"`
+	// Volumes maps volume IDs to the space allocated to each.
+	Volumes map[string]int64 `json:"volumes,omitempty"`
+}
+
+// Factory creates an engine from its options in the backend config.
+type Factory func(options map[string]string) (StorageEngine, error)
+
+// engines holds the factories of every engine, by the name the backend
+// config selects them with.
+var engines = map[string]Factory{
+	SparseFileName: NewSparseFile,
+	LVMThinName:    NewLVMThin,
+}
+
+// New creates the engine registered under name.
+func New(name string, options map[string]string) (StorageEngine, error) {
+	factory, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage engine %q, expected one of %s", name, strings.Join(Names(), ", "))
+	}
+	return factory(options)
+}
+
+// Names returns the names of the registered engines, sorted.
+func Names() []string {
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkOptions returns an error naming any option not in known, so a
+// misspelt option isn't silently ignored.
+func checkOptions(engine string, options map[string]string, known ...string) error {
+	var unknown []string
+	for k := range options {
+		found := false
+		for _, want := range known {
+			if k == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s engine: unknown options %s", engine, strings.Join(unknown, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LVMThinName selects the LVM thin pool engine in the backend config.
+const LVMThinName = "lvm-thin"
+
+// Prefixes of the logical volumes the engine creates, so they can't clash
+// with anything else in the volume group.
+const (
+	lvmVolumePrefix   = "csi-vol-"
+	lvmSnapshotPrefix = "csi-snap-"
+)
+
+// Executor runs a command and returns its standard output. Engines run
+// their tools through it so tests can check the commands without the
+// tools installed.
+type Executor interface {
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// commandExecutor is the Executor that really runs commands.
+type commandExecutor struct{}
+
+func (commandExecutor) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.Bytes(), fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// LVMThin keeps each volume in a thin logical volume of a thin pool, and
+// snapshots as thin snapshots of them. Hosts get the logical volume's
+// block device exported.
+//
+// Options:
+//
+//	volumeGroup  volume group holding the thin pool (required)
+//	thinPool     thin pool the volumes are allocated from (required)
+type LVMThin struct {
+	vg   string
+	pool string
+	exec Executor
+}
+
+// NewLVMThin creates an LVM thin pool engine from its config options.
+func NewLVMThin(options map[string]string) (StorageEngine, error) {
+	return NewLVMThinWithExecutor(options, commandExecutor{})
+}
+
+// NewLVMThinWithExecutor creates an LVM thin pool engine that runs the LVM
+// commands through executor.
+func NewLVMThinWithExecutor(options map[string]string, executor Executor) (*LVMThin, error) {
+	if err := checkOptions(LVMThinName, options, "volumeGroup", "thinPool"); err != nil {
+		return nil, err
+	}
+	e := &LVMThin{vg: options["volumeGroup"], pool: options["thinPool"], exec: executor}
+	if e.vg == "" || e.pool == "" {
+		return nil, fmt.Errorf("%s engine: the volumeGroup and thinPool options are required", LVMThinName)
+	}
+	return e, nil
+}
+
+// reLVMID matches the IDs that, once prefixed, are valid LV names.
+var reLVMID = regexp.MustCompile(`^[a-zA-Z0-9+_.-]{1,100}$`)
+
+func lvName(prefix, id string) (string, error) {
+	if !reLVMID.MatchString(id) {
+		return "", fmt.Errorf("invalid volume or snapshot ID %q", id)
+	}
+	return prefix + id, nil
+}
+
+// lv is a row of the lvs report.
+type lv struct {
+	Name            string `json:"lv_name"`
+	Size            string `json:"lv_size"`
+	Pool            string `json:"pool_lv"`
+	DataPercent     string `json:"data_percent"`
+	MetadataSize    string `json:"lv_metadata_size"`
+	MetadataPercent string `json:"metadata_percent"`
+}
+
+// lvFields are the lvs columns lv is filled from.
+const lvFields = "lv_name,lv_size,pool_lv,data_percent,lv_metadata_size,metadata_percent"
+
+// listLVs returns the logical volumes of the volume group by name.
+func (e *LVMThin) listLVs(ctx context.Context) (map[string]lv, error) {
+	out, err := e.exec.Run(ctx, "lvs", "--reportformat", "json", "--units", "b", "--nosuffix",
+		"--options", lvFields, e.vg)
+	if err != nil {
+		return nil, err
+	}
+	var report struct {
+		Report []struct {
+			LV []lv `json:"lv"`
+		} `json:"report"`
+	}
+	if err := json.Unmarshal(out, &report); err != nil {
+		return nil, fmt.Errorf("parsing lvs output: %w", err)
+	}
+	lvs := make(map[string]lv)
+	for _, r := range report.Report {
+		for _, l := range r.LV {
+			lvs[l.Name] = l
+		}
+	}
+	return lvs, nil
+}
+
+// lookup returns the named logical volume, or ErrNotFound.
+func (e *LVMThin) lookup(ctx context.Context, name string) (lv, error) {
+	lvs, err := e.listLVs(ctx)
+	if err != nil {
+		return lv{}, err
+	}
+	l, ok := lvs[name]
+	if !ok {
+		return lv{}, ErrNotFound
+	}
+	return l, nil
+}
+
+func (e *LVMThin) Create(ctx context.Context, id string, sizeBytes int64) error {
+	name, err := lvName(lvmVolumePrefix, id)
+	if err != nil {
+		return err
+	}
+	if _, err := e.lookup(ctx, name); err == nil {
+		return ErrAlreadyExists
+	} else if err != ErrNotFound {
+		return err
+	}
+	_, err = e.exec.Run(ctx, "lvcreate", "--yes", "--type", "thin",
+		"--virtualsize", bytesArg(sizeBytes), "--thinpool", e.pool, "--name", name, e.vg)
+	return err
+}
+
+func (e *LVMThin) Delete(ctx context.Context, id string) error {
+	name, err := lvName(lvmVolumePrefix, id)
+	if err != nil {
+		return err
+	}
+	return e.remove(ctx, name)
+}
+
+// remove removes a logical volume, succeeding if it doesn't exist.
+func (e *LVMThin) remove(ctx context.Context, name string) error {
+	if _, err := e.lookup(ctx, name); err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err := e.exec.Run(ctx, "lvremove", "--yes", e.vg+"/"+name)
+	return err
+}
+
+func (e *LVMThin) Resize(ctx context.Context, id string, sizeBytes int64) error {
+	name, err := lvName(lvmVolumePrefix, id)
+	if err != nil {
+		return err
+	}
+	l, err := e.lookup(ctx, name)
+	if err != nil {
+		return err
+	}
+	return e.extend(ctx, l, sizeBytes)
+}
+
+// extend grows the logical volume to sizeBytes. LVM rounds the size up to
+// whole extents, so the volume may end up slightly larger, and a volume
+// that is already at least sizeBytes is left alone: retrying a resize asks
+// for less than the rounded up size. The API refuses real shrinks.
+func (e *LVMThin) extend(ctx context.Context, l lv, sizeBytes int64) error {
+	current, err := parseBytes(l.Size)
+	if err != nil {
+		return err
+	}
+	if sizeBytes <= current {
+		return nil
+	}
+	_, err = e.exec.Run(ctx, "lvextend", "--size", bytesArg(sizeBytes), e.vg+"/"+l.Name)
+	return err
+}
+
+func (e *LVMThin) Snapshot(ctx context.Context, volumeID, snapshotID string) (int64, error) {
+	origin, err := lvName(lvmVolumePrefix, volumeID)
+	if err != nil {
+		return 0, err
+	}
+	name, err := lvName(lvmSnapshotPrefix, snapshotID)
+	if err != nil {
+		return 0, err
+	}
+	lvs, err := e.listLVs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := lvs[name]; ok {
+		return 0, ErrAlreadyExists
+	}
+	l, ok := lvs[origin]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	// A thin snapshot needs no size, it shares the origin's blocks. It is
+	// left inactive, as thin snapshots are by default, until cloned.
+	if _, err := e.exec.Run(ctx, "lvcreate", "--yes", "--snapshot", "--name", name, e.vg+"/"+origin); err != nil {
+		return 0, err
+	}
+	return parseBytes(l.Size)
+}
+
+func (e *LVMThin) DeleteSnapshot(ctx context.Context, snapshotID string) error {
+	name, err := lvName(lvmSnapshotPrefix, snapshotID)
+	if err != nil {
+		return err
+	}
+	return e.remove(ctx, name)
+}
+
+func (e *LVMThin) Clone(ctx context.Context, id string, sizeBytes int64, source Source) error {
+	name, err := lvName(lvmVolumePrefix, id)
+	if err != nil {
+		return err
+	}
+	var origin string
+	if source.SnapshotID != "" {
+		origin, err = lvName(lvmSnapshotPrefix, source.SnapshotID)
+	} else {
+		origin, err = lvName(lvmVolumePrefix, source.VolumeID)
+	}
+	if err != nil {
+		return err
+	}
+	lvs, err := e.listLVs(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := lvs[name]; ok {
+		return ErrAlreadyExists
+	}
+	l, ok := lvs[origin]
+	if !ok {
+		return ErrNotFound
+	}
+
+	// The clone is a thin snapshot of the source that, unlike a snapshot,
+	// gets activated like any other volume.
+	_, err = e.exec.Run(ctx, "lvcreate", "--yes", "--snapshot", "--setactivationskip", "n",
+		"--name", name, e.vg+"/"+origin)
+	if err != nil {
+		return err
+	}
+	if _, err := e.exec.Run(ctx, "lvchange", "--activate", "y", e.vg+"/"+name); err != nil {
+		e.remove(ctx, name)
+		return err
+	}
+	l.Name = name
+	if err := e.extend(ctx, l, sizeBytes); err != nil {
+		e.remove(ctx, name)
+		return err
+	}
+	return nil
+}
+
+func (e *LVMThin) Usage(ctx context.Context) (Usage, error) {
+	usage := Usage{Engine: LVMThinName, Volumes: make(map[string]int64)}
+	lvs, err := e.listLVs(ctx)
+	if err != nil {
+		return usage, err
+	}
+	pool, ok := lvs[e.pool]
+	if !ok {
+		return usage, fmt.Errorf("thin pool %s/%s not found", e.vg, e.pool)
+	}
+	if usage.CapacityBytes, err = parseBytes(pool.Size); err != nil {
+		return usage, err
+	}
+	if usage.AllocatedBytes, err = percentOf(pool.DataPercent, usage.CapacityBytes); err != nil {
+		return usage, err
+	}
+	if usage.MetadataCapacityBytes, err = parseBytes(pool.MetadataSize); err != nil {
+		return usage, err
+	}
+	if usage.MetadataAllocatedBytes, err = percentOf(pool.MetadataPercent, usage.MetadataCapacityBytes); err != nil {
+		return usage, err
+	}
+
+	for _, l := range lvs {
+		id, ok := strings.CutPrefix(l.Name, lvmVolumePrefix)
+		if !ok || l.Pool != e.pool {
+			continue
+		}
+		size, err := parseBytes(l.Size)
+		if err != nil {
+			return usage, err
+		}
+		if usage.Volumes[id], err = percentOf(l.DataPercent, size); err != nil {
+			return usage, err
+		}
+	}
+	return usage, nil
+}
+
+func (e *LVMThin) Export(ctx context.Context, id string) (string, error) {
+	name, err := lvName(lvmVolumePrefix, id)
+	if err != nil {
+		return "", err
+	}
+	if _, err := e.lookup(ctx, name); err != nil {
+		return "", err
+	}
+	return "/dev/" + e.vg + "/" + name, nil
+}
+
+// bytesArg formats a size for LVM's size options.
+func bytesArg(n int64) string {
+	return strconv.FormatInt(n, 10) + "b"
+}
+
+// parseBytes parses a size reported with --units b --nosuffix.
+func parseBytes(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing lvs size %q: %w", s, err)
+	}
+	return n, nil
+}
+
+// percentOf returns percent, as reported by lvs, of total.
+func percentOf(percent string, total int64) (int64, error) {
+	if percent == "" {
+		return 0, nil
+	}
+	p, err := strconv.ParseFloat(percent, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing lvs percentage %q: %w", percent, err)
+	}
+	return int64(p / 100 * float64(total)), nil
+}
@@ -0,0 +1,283 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeExecutor records the commands it's asked to run. It answers lvs with
+// a report of lvs, or with output when that is set, and fails the commands
+// named in fail.
+type fakeExecutor struct {
+	lvs      []lv
+	output   string
+	fail     map[string]error
+	commands []string
+}
+
+func (f *fakeExecutor) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	f.commands = append(f.commands, strings.Join(append([]string{name}, args...), " "))
+	if err := f.fail[name]; err != nil {
+		return nil, err
+	}
+	if name != "lvs" {
+		return nil, nil
+	}
+	if f.output != "" {
+		return []byte(f.output), nil
+	}
+	report := map[string]any{"report": []any{map[string]any{"lv": f.lvs}}}
+	return json.Marshal(report)
+}
+
+const lvsCommand = "lvs --reportformat json --units b --nosuffix --options " + lvFields + " vg0"
+
+// fakeLVs are the logical volumes of the vg0 volume group: the thin pool,
+// a volume and a snapshot of it, and an LV that doesn't belong to the engine.
+var fakeLVs = []lv{
+	{Name: "pool0", Size: "10737418240", DataPercent: "12.50", MetadataSize: "16777216", MetadataPercent: "25.00"},
+	{Name: "csi-vol-vol1", Size: "1073741824", Pool: "pool0", DataPercent: "50.00"},
+	{Name: "csi-snap-snap1", Size: "1073741824", Pool: "pool0", DataPercent: "50.00"},
+	{Name: "root", Size: "21474836480"},
+}
+
+func newLVMThin(t *testing.T, lvs ...lv) (*LVMThin, *fakeExecutor) {
+	t.Helper()
+	executor := &fakeExecutor{lvs: lvs}
+	e, err := NewLVMThinWithExecutor(map[string]string{"volumeGroup": "vg0", "thinPool": "pool0"}, executor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, executor
+}
+
+func checkCommands(t *testing.T, executor *fakeExecutor, want ...string) {
+	t.Helper()
+	if !reflect.DeepEqual(executor.commands, want) {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(executor.commands, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestNewLVMThin(t *testing.T) {
+	for _, options := range []map[string]string{
+		{"volumeGroup": "vg0"},
+		{"thinPool": "pool0"},
+		{"volumeGroup": "vg0", "thinPool": "pool0", "dir": "/tmp"},
+	} {
+		if _, err := NewLVMThinWithExecutor(options, &fakeExecutor{}); err == nil {
+			t.Errorf("NewLVMThinWithExecutor(%v) succeeded", options)
+		}
+	}
+}
+
+func TestLVMThinCreate(t *testing.T) {
+	ctx := context.Background()
+	e, executor := newLVMThin(t, fakeLVs...)
+	if err := e.Create(ctx, "vol2", 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	checkCommands(t, executor, lvsCommand,
+		"lvcreate --yes --type thin --virtualsize 1073741824b --thinpool pool0 --name csi-vol-vol2 vg0")
+
+	executor.commands = nil
+	if err := e.Create(ctx, "vol1", 1<<30); err != ErrAlreadyExists {
+		t.Errorf("Create() of an existing volume error = %v, want ErrAlreadyExists", err)
+	}
+	checkCommands(t, executor, lvsCommand)
+
+	for _, id := range []string{"", "a/b", "a b", strings.Repeat("x", 101)} {
+		if err := e.Create(ctx, id, 1<<30); err == nil {
+			t.Errorf("Create(%q) succeeded, want an invalid ID error", id)
+		}
+	}
+}
+
+func TestLVMThinResize(t *testing.T) {
+	ctx := context.Background()
+	e, executor := newLVMThin(t, fakeLVs...)
+	if err := e.Resize(ctx, "vol1", 2<<30); err != nil {
+		t.Fatal(err)
+	}
+	checkCommands(t, executor, lvsCommand, "lvextend --size 2147483648b vg0/csi-vol-vol1")
+
+	// The volume is already large enough.
+	executor.commands = nil
+	if err := e.Resize(ctx, "vol1", 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	checkCommands(t, executor, lvsCommand)
+
+	if err := e.Resize(ctx, "missing", 1<<30); err != ErrNotFound {
+		t.Errorf("Resize() of a missing volume error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLVMThinResizeRoundedUp(t *testing.T) {
+	ctx := context.Background()
+	// A "3G" request was 2862MiB once aligned, which LVM rounded up to
+	// whole 4MiB extents.
+	e, executor := newLVMThin(t, fakeLVs[0], lv{Name: "csi-vol-vol2", Size: "3003121664", Pool: "pool0"})
+	if err := e.Resize(ctx, "vol2", 2862<<20); err != nil {
+		t.Fatalf("Resize() retried below the rounded up size: %v", err)
+	}
+	checkCommands(t, executor, lvsCommand)
+
+	executor.commands = nil
+	if err := e.Resize(ctx, "vol2", 2866<<20); err != nil {
+		t.Fatal(err)
+	}
+	checkCommands(t, executor, lvsCommand, "lvextend --size 3005218816b vg0/csi-vol-vol2")
+}
+
+func TestLVMThinSnapshot(t *testing.T) {
+	ctx := context.Background()
+	e, executor := newLVMThin(t, fakeLVs...)
+	size, err := e.Snapshot(ctx, "vol1", "snap2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 1<<30 {
+		t.Errorf("Snapshot() size = %d, want %d", size, 1<<30)
+	}
+	checkCommands(t, executor, lvsCommand, "lvcreate --yes --snapshot --name csi-snap-snap2 vg0/csi-vol-vol1")
+
+	if _, err := e.Snapshot(ctx, "vol1", "snap1"); err != ErrAlreadyExists {
+		t.Errorf("Snapshot() of an existing snapshot error = %v, want ErrAlreadyExists", err)
+	}
+	if _, err := e.Snapshot(ctx, "missing", "snap2"); err != ErrNotFound {
+		t.Errorf("Snapshot() of a missing volume error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLVMThinClone(t *testing.T) {
+	ctx := context.Background()
+	e, executor := newLVMThin(t, fakeLVs...)
+	if err := e.Clone(ctx, "vol2", 2<<30, Source{SnapshotID: "snap1"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCommands(t, executor, lvsCommand,
+		"lvcreate --yes --snapshot --setactivationskip n --name csi-vol-vol2 vg0/csi-snap-snap1",
+		"lvchange --activate y vg0/csi-vol-vol2",
+		"lvextend --size 2147483648b vg0/csi-vol-vol2")
+
+	// A clone of the source's size isn't extended.
+	executor.commands = nil
+	if err := e.Clone(ctx, "vol3", 1<<30, Source{VolumeID: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCommands(t, executor, lvsCommand,
+		"lvcreate --yes --snapshot --setactivationskip n --name csi-vol-vol3 vg0/csi-vol-vol1",
+		"lvchange --activate y vg0/csi-vol-vol3")
+
+	if err := e.Clone(ctx, "vol1", 1<<30, Source{SnapshotID: "snap1"}); err != ErrAlreadyExists {
+		t.Errorf("Clone() onto an existing volume error = %v, want ErrAlreadyExists", err)
+	}
+	if err := e.Clone(ctx, "vol4", 1<<30, Source{SnapshotID: "missing"}); err != ErrNotFound {
+		t.Errorf("Clone() of a missing snapshot error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLVMThinCloneActivationFailure(t *testing.T) {
+	ctx := context.Background()
+	// The fake's lvs doesn't see the clone, so removing it again stops
+	// at the lookup.
+	e, executor := newLVMThin(t, fakeLVs...)
+	activateErr := errors.New("activation failed")
+	executor.fail = map[string]error{"lvchange": activateErr}
+	if err := e.Clone(ctx, "vol2", 1<<30, Source{SnapshotID: "snap1"}); err != activateErr {
+		t.Errorf("Clone() error = %v, want %v", err, activateErr)
+	}
+	checkCommands(t, executor, lvsCommand,
+		"lvcreate --yes --snapshot --setactivationskip n --name csi-vol-vol2 vg0/csi-snap-snap1",
+		"lvchange --activate y vg0/csi-vol-vol2",
+		lvsCommand)
+}
+
+func TestLVMThinDelete(t *testing.T) {
+	ctx := context.Background()
+	e, executor := newLVMThin(t, fakeLVs...)
+	if err := e.Delete(ctx, "vol1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.DeleteSnapshot(ctx, "snap1"); err != nil {
+		t.Fatal(err)
+	}
+	// Deleting what's already gone succeeds without running lvremove.
+	if err := e.Delete(ctx, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	checkCommands(t, executor,
+		lvsCommand, "lvremove --yes vg0/csi-vol-vol1",
+		lvsCommand, "lvremove --yes vg0/csi-snap-snap1",
+		lvsCommand)
+}
+
+func TestLVMThinExport(t *testing.T) {
+	ctx := context.Background()
+	e, _ := newLVMThin(t, fakeLVs...)
+	path, err := e.Export(ctx, "vol1")
+	if err != nil || path != "/dev/vg0/csi-vol-vol1" {
+		t.Errorf("Export() = %q, %v, want /dev/vg0/csi-vol-vol1", path, err)
+	}
+	if _, err := e.Export(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("Export() of a missing volume error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLVMThinUsage(t *testing.T) {
+	ctx := context.Background()
+	e, _ := newLVMThin(t, fakeLVs...)
+	usage, err := e.Usage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Usage{
+		Engine:                 LVMThinName,
+		CapacityBytes:          10 << 30,
+		AllocatedBytes:         10 << 30 / 8,
+		MetadataCapacityBytes:  16 << 20,
+		MetadataAllocatedBytes: 4 << 20,
+		Volumes:                map[string]int64{"vol1": 512 << 20},
+	}
+	if !reflect.DeepEqual(usage, want) {
+		t.Errorf("Usage() = %+v, want %+v", usage, want)
+	}
+}
+
+func TestLVMThinUsageErrors(t *testing.T) {
+	ctx := context.Background()
+	pool := fakeLVs[0]
+	tests := []struct {
+		name   string
+		lvs    []lv
+		output string
+		want   string
+	}{
+		{name: "not json", output: "  WARNING: something\n", want: "parsing lvs output"},
+		{name: "wrong shape", output: `{"report": {"lv": []}}`, want: "parsing lvs output"},
+		{name: "no pool", lvs: fakeLVs[1:], want: "thin pool vg0/pool0 not found"},
+		{name: "bad pool size", lvs: []lv{{Name: "pool0", Size: "10G"}}, want: "parsing lvs size"},
+		{name: "bad percentage", lvs: []lv{{Name: "pool0", Size: pool.Size, DataPercent: "12,5"}}, want: "parsing lvs percentage"},
+		{name: "bad volume size", lvs: []lv{pool, {Name: "csi-vol-vol1", Size: "1.0g", Pool: "pool0"}}, want: "parsing lvs size"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, executor := newLVMThin(t, test.lvs...)
+			executor.output = test.output
+			if _, err := e.Usage(ctx); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Usage() error = %v, want %q", err, test.want)
+			}
+		})
+	}
+
+	e, executor := newLVMThin(t)
+	lvsErr := errors.New("lvs failed")
+	executor.fail = map[string]error{"lvs": lvsErr}
+	if _, err := e.Usage(ctx); err != lvsErr {
+		t.Errorf("Usage() error = %v, want %v", err, lvsErr)
+	}
+}
@@ -0,0 +1,330 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// SparseFileName selects the sparse file engine in the backend config.
+const SparseFileName = "sparse-file"
+
+// SparseFile keeps each volume in a sparse file under a directory, which
+// the target exports as a file backed namespace. It needs no spare disks,
+// which makes it the engine for development and CI.
+//
+// Snapshots are copies of the volume file, reflinked where the filesystem
+// supports it, taken without quiescing the volume: they are only crash
+// consistent.
+//
+// Options:
+//
+//	dir          directory holding the volume files (required)
+//	preallocate  "true" to allocate every block up front with fallocate,
+//	             rather than as the volume is written
+type SparseFile struct {
+	dir         string
+	preallocate bool
+}
+
+// NewSparseFile creates a sparse file engine from its config options.
+func NewSparseFile(options map[string]string) (StorageEngine, error) {
+	if err := checkOptions(SparseFileName, options, "dir", "preallocate"); err != nil {
+		return nil, err
+	}
+	e := &SparseFile{dir: options["dir"]}
+	if e.dir == "" {
+		return nil, fmt.Errorf("%s engine: the dir option is required", SparseFileName)
+	}
+	if v, ok := options["preallocate"]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s engine: preallocate: %v", SparseFileName, err)
+		}
+		e.preallocate = b
+	}
+	if err := os.MkdirAll(e.snapshotDir(), 0700); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *SparseFile) snapshotDir() string {
+	return filepath.Join(e.dir, "snapshots")
+}
+
+// volumePath returns the file holding a volume.
+func (e *SparseFile) volumePath(id string) (string, error) {
+	if err := checkID(id); err != nil {
+		return "", err
+	}
+	return filepath.Join(e.dir, id+".img"), nil
+}
+
+// snapshotPath returns the file holding a snapshot.
+func (e *SparseFile) snapshotPath(id string) (string, error) {
+	if err := checkID(id); err != nil {
+		return "", err
+	}
+	return filepath.Join(e.snapshotDir(), id+".img"), nil
+}
+
+func (e *SparseFile) Create(ctx context.Context, id string, sizeBytes int64) error {
+	path, err := e.volumePath(id)
+	if err != nil {
+		return err
+	}
+	return e.createFile(path, sizeBytes, nil)
+}
+
+// createFile creates a new file of sizeBytes, with the contents of src if
+// it isn't nil. The file is removed again if anything fails.
+func (e *SparseFile) createFile(path string, sizeBytes int64, src *os.File) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return ErrAlreadyExists
+	} else if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	if src != nil {
+		if err := copySparse(f, src); err != nil {
+			return err
+		}
+	}
+	if err := e.grow(f, sizeBytes); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// grow extends the file to sizeBytes, allocating the new blocks when
+// preallocating.
+func (e *SparseFile) grow(f *os.File, sizeBytes int64) error {
+	if e.preallocate {
+		// Mode 0 allocates the range and extends the file size with it.
+		return unix.Fallocate(int(f.Fd()), 0, 0, sizeBytes)
+	}
+	return f.Truncate(sizeBytes)
+}
+
+func (e *SparseFile) Delete(ctx context.Context, id string) error {
+	path, err := e.volumePath(id)
+	if err != nil {
+		return err
+	}
+	return removeFile(path)
+}
+
+func (e *SparseFile) Resize(ctx context.Context, id string, sizeBytes int64) error {
+	path, err := e.volumePath(id)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if sizeBytes < info.Size() {
+		return fmt.Errorf("volume %s is %d bytes, can't shrink it to %d", id, info.Size(), sizeBytes)
+	}
+	if sizeBytes == info.Size() {
+		return nil
+	}
+	if err := e.grow(f, sizeBytes); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (e *SparseFile) Snapshot(ctx context.Context, volumeID, snapshotID string) (int64, error) {
+	src, err := e.volumePath(volumeID)
+	if err != nil {
+		return 0, err
+	}
+	dst, err := e.snapshotPath(snapshotID)
+	if err != nil {
+		return 0, err
+	}
+	return e.copyFile(dst, src, 0)
+}
+
+func (e *SparseFile) DeleteSnapshot(ctx context.Context, snapshotID string) error {
+	path, err := e.snapshotPath(snapshotID)
+	if err != nil {
+		return err
+	}
+	return removeFile(path)
+}
+
+func (e *SparseFile) Clone(ctx context.Context, id string, sizeBytes int64, source Source) error {
+	var src string
+	var err error
+	if source.SnapshotID != "" {
+		src, err = e.snapshotPath(source.SnapshotID)
+	} else {
+		src, err = e.volumePath(source.VolumeID)
+	}
+	if err != nil {
+		return err
+	}
+	dst, err := e.volumePath(id)
+	if err != nil {
+		return err
+	}
+	_, err = e.copyFile(dst, src, sizeBytes)
+	return err
+}
+
+// copyFile creates dst as a copy of src grown to at least sizeBytes, and
+// returns its size.
+func (e *SparseFile) copyFile(dst, src string, sizeBytes int64) (int64, error) {
+	f, err := os.Open(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	sizeBytes = max(sizeBytes, info.Size())
+	if err := e.createFile(dst, sizeBytes, f); err != nil {
+		return 0, err
+	}
+	return sizeBytes, nil
+}
+
+func (e *SparseFile) Usage(ctx context.Context) (Usage, error) {
+	usage := Usage{Engine: SparseFileName, Volumes: make(map[string]int64)}
+	var st unix.Statfs_t
+	if err := unix.Statfs(e.dir, &st); err != nil {
+		return usage, err
+	}
+	usage.CapacityBytes = int64(st.Blocks) * int64(st.Bsize)
+
+	for _, dir := range []string{e.dir, e.snapshotDir()} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return usage, err
+		}
+		for _, entry := range entries {
+			id, ok := strings.CutSuffix(entry.Name(), ".img")
+			if !ok || !entry.Type().IsRegular() {
+				continue
+			}
+			allocated, err := allocatedBytes(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return usage, err
+			}
+			usage.AllocatedBytes += allocated
+			if dir == e.dir {
+				usage.Volumes[id] = allocated
+			}
+		}
+	}
+	return usage, nil
+}
+
+func (e *SparseFile) Export(ctx context.Context, id string) (string, error) {
+	path, err := e.volumePath(id)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// allocatedBytes returns the space the file's blocks take on disk, which
+// for a sparse file is less than its size.
+func allocatedBytes(path string) (int64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	// st_blocks is always in 512 byte units.
+	return int64(st.Blocks) * 512, nil
+}
+
+// copySparse copies src into the empty file dst. It shares the blocks when
+// the filesystem can reflink them, and otherwise copies only the data
+// regions, so holes stay holes.
+func copySparse(dst, src *os.File) error {
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err == nil {
+		return nil
+	}
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(int(src.Fd()), offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// Only a hole is left.
+			break
+		} else if errors.Is(err, unix.EINVAL) {
+			// No SEEK_DATA support, copy the rest as is.
+			data = offset
+		} else if err != nil {
+			return err
+		}
+		hole, err := unix.Seek(int(src.Fd()), data, unix.SEEK_HOLE)
+		if err != nil {
+			hole = size
+		}
+		section := io.NewSectionReader(src, data, hole-data)
+		if _, err := io.Copy(io.NewOffsetWriter(dst, data), section); err != nil {
+			return err
+		}
+		offset = hole
+	}
+	return dst.Truncate(size)
+}
+
+// removeFile removes a file, succeeding if it doesn't exist.
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// checkID rejects IDs that can't safely be used as a file name.
+func checkID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, "/\x00") {
+		return fmt.Errorf("invalid volume or snapshot ID %q", id)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const mib = 1 << 20
+
+func newSparseFile(t *testing.T) *SparseFile {
+	t.Helper()
+	e, err := NewSparseFile(map[string]string{"dir": t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.(*SparseFile)
+}
+
+// requireSparse skips the test when the filesystem under the engine's dir
+// allocates every block of a file, as holes can't be checked there.
+func requireSparse(t *testing.T, e *SparseFile) {
+	t.Helper()
+	path := filepath.Join(e.dir, "probe")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	if err := os.Truncate(path, 16*mib); err != nil {
+		t.Fatal(err)
+	}
+	if allocated, err := allocatedBytes(path); err != nil || allocated > 0 {
+		t.Skipf("%s doesn't support sparse files", e.dir)
+	}
+}
+
+// writeAt writes data into a volume file at each of the offsets.
+func writeAt(t *testing.T, path string, data []byte, offsets ...int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, offset := range offsets {
+		if _, err := f.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestSparseFileCreate(t *testing.T) {
+	ctx := context.Background()
+	e := newSparseFile(t)
+	requireSparse(t, e)
+	if err := e.Create(ctx, "vol1", 64*mib); err != nil {
+		t.Fatal(err)
+	}
+	path, err := e.Export(ctx, "vol1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, path); size != 64*mib {
+		t.Errorf("size = %d, want %d", size, 64*mib)
+	}
+	if allocated, err := allocatedBytes(path); err != nil || allocated != 0 {
+		t.Errorf("allocated = %d, %v, want a sparse file", allocated, err)
+	}
+	if err := e.Create(ctx, "vol1", 64*mib); err != ErrAlreadyExists {
+		t.Errorf("Create() again error = %v, want ErrAlreadyExists", err)
+	}
+	for _, id := range []string{"", "..", "a/b"} {
+		if err := e.Create(ctx, id, mib); err == nil {
+			t.Errorf("Create(%q) succeeded, want an invalid ID error", id)
+		}
+	}
+}
+
+func TestSparseFilePreallocate(t *testing.T) {
+	ctx := context.Background()
+	e, err := NewSparseFile(map[string]string{"dir": t.TempDir(), "preallocate": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Create(ctx, "vol1", 4*mib); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := e.Export(ctx, "vol1")
+	if allocated, err := allocatedBytes(path); err != nil || allocated < 4*mib {
+		t.Errorf("allocated = %d, %v, want at least %d", allocated, err, 4*mib)
+	}
+}
+
+func TestSparseFileResize(t *testing.T) {
+	ctx := context.Background()
+	e := newSparseFile(t)
+	if err := e.Create(ctx, "vol1", 8*mib); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := e.Export(ctx, "vol1")
+	data := bytes.Repeat([]byte{0xa5}, 4096)
+	writeAt(t, path, data, 0)
+
+	for _, size := range []int64{16 * mib, 16 * mib} {
+		if err := e.Resize(ctx, "vol1", size); err != nil {
+			t.Fatal(err)
+		}
+		if got := fileSize(t, path); got != size {
+			t.Errorf("size after Resize(%d) = %d", size, got)
+		}
+	}
+	if err := e.Resize(ctx, "vol1", 4*mib); err == nil {
+		t.Error("Resize() to a smaller size succeeded")
+	}
+	if got := fileSize(t, path); got != 16*mib {
+		t.Errorf("size after a refused shrink = %d, want %d", got, 16*mib)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content[:len(data)], data) {
+		t.Error("Resize() lost the volume's contents")
+	}
+	if err := e.Resize(ctx, "missing", 16*mib); err != ErrNotFound {
+		t.Errorf("Resize() of a missing volume error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSparseFileSnapshotAndClone(t *testing.T) {
+	ctx := context.Background()
+	e := newSparseFile(t)
+	requireSparse(t, e)
+	if err := e.Create(ctx, "vol1", 32*mib); err != nil {
+		t.Fatal(err)
+	}
+	volume, _ := e.Export(ctx, "vol1")
+	data := bytes.Repeat([]byte{0x5a}, 64*1024)
+	writeAt(t, volume, data, 0, 16*mib)
+	want, err := os.ReadFile(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := e.Snapshot(ctx, "vol1", "snap1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 32*mib {
+		t.Errorf("Snapshot() size = %d, want %d", size, 32*mib)
+	}
+	if _, err := e.Snapshot(ctx, "vol1", "snap1"); err != ErrAlreadyExists {
+		t.Errorf("Snapshot() again error = %v, want ErrAlreadyExists", err)
+	}
+	if _, err := e.Snapshot(ctx, "missing", "snap2"); err != ErrNotFound {
+		t.Errorf("Snapshot() of a missing volume error = %v, want ErrNotFound", err)
+	}
+
+	// Writes to the volume after the snapshot don't reach it.
+	writeAt(t, volume, bytes.Repeat([]byte{0xff}, 4096), 8*mib)
+
+	if err := e.Clone(ctx, "vol2", 64*mib, Source{SnapshotID: "snap1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Clone(ctx, "vol3", 0, Source{VolumeID: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Clone(ctx, "vol4", 0, Source{SnapshotID: "missing"}); err != ErrNotFound {
+		t.Errorf("Clone() of a missing snapshot error = %v, want ErrNotFound", err)
+	}
+
+	snapshot, _ := e.snapshotPath("snap1")
+	clone, _ := e.Export(ctx, "vol2")
+	for _, path := range []string{snapshot, clone} {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[:len(want)], want) {
+			t.Errorf("%s doesn't match the volume at snapshot time", path)
+		}
+		if !bytes.Equal(got[len(want):], make([]byte, len(got)-len(want))) {
+			t.Errorf("%s isn't zero past the volume's end", path)
+		}
+		// Each copy holds the two written chunks, not the whole volume.
+		if allocated, _ := allocatedBytes(path); allocated >= 32*mib {
+			t.Errorf("%s has %d bytes allocated, the holes weren't kept", path, allocated)
+		}
+	}
+	if size := fileSize(t, clone); size != 64*mib {
+		t.Errorf("clone size = %d, want %d", size, 64*mib)
+	}
+	if vol3, _ := e.Export(ctx, "vol3"); fileSize(t, vol3) != 32*mib {
+		t.Errorf("clone of a volume size = %d, want %d", fileSize(t, vol3), 32*mib)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := e.DeleteSnapshot(ctx, "snap1"); err != nil {
+			t.Fatalf("DeleteSnapshot() #%d: %v", i+1, err)
+		}
+	}
+}
+
+func TestCopySparse(t *testing.T) {
+	dir := t.TempDir()
+	src, err := os.Create(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if err := src.Truncate(16 * mib); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{0x3c}, 4096)
+	for _, offset := range []int64{mib, 10 * mib} {
+		if _, err := src.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := copySparse(dst, src); err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := os.ReadFile(src.Name())
+	got, _ := os.ReadFile(dst.Name())
+	if !bytes.Equal(got, want) {
+		t.Error("copy doesn't match its source")
+	}
+	srcAllocated, _ := allocatedBytes(src.Name())
+	dstAllocated, _ := allocatedBytes(dst.Name())
+	if dstAllocated > srcAllocated {
+		t.Errorf("copy has %d bytes allocated, source %d", dstAllocated, srcAllocated)
+	}
+}
+
+func TestSparseFileUsage(t *testing.T) {
+	ctx := context.Background()
+	e := newSparseFile(t)
+	requireSparse(t, e)
+	for _, id := range []string{"vol1", "vol2"} {
+		if err := e.Create(ctx, id, 64*mib); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vol1, _ := e.Export(ctx, "vol1")
+	writeAt(t, vol1, bytes.Repeat([]byte{1}, mib), 0)
+	if _, err := e.Snapshot(ctx, "vol1", "snap1"); err != nil {
+		t.Fatal(err)
+	}
+	// Files that aren't volumes are ignored.
+	if err := os.WriteFile(filepath.Join(e.dir, "notes.txt"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := e.Usage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Engine != SparseFileName || usage.CapacityBytes <= 0 {
+		t.Errorf("Usage() = %+v", usage)
+	}
+	if len(usage.Volumes) != 2 {
+		t.Errorf("Usage() volumes = %v, want vol1 and vol2", usage.Volumes)
+	}
+	// Usage counts the blocks on disk, not the 64MiB apparent size.
+	if got := usage.Volumes["vol1"]; got < mib || got >= 64*mib {
+		t.Errorf("vol1 usage = %d, want about %d", got, mib)
+	}
+	if got := usage.Volumes["vol2"]; got != 0 {
+		t.Errorf("vol2 usage = %d, want 0", got)
+	}
+	snapshot, _ := e.snapshotPath("snap1")
+	snapshotAllocated, _ := allocatedBytes(snapshot)
+	if want := usage.Volumes["vol1"] + snapshotAllocated; usage.AllocatedBytes != want {
+		t.Errorf("allocated = %d, want %d", usage.AllocatedBytes, want)
+	}
+}
+
+func TestSparseFileDelete(t *testing.T) {
+	ctx := context.Background()
+	e := newSparseFile(t)
+	if err := e.Create(ctx, "vol1", mib); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := e.Delete(ctx, "vol1"); err != nil {
+			t.Fatalf("Delete() #%d: %v", i+1, err)
+		}
+	}
+	if _, err := e.Export(ctx, "vol1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Export() after deleting error = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,419 @@
+// Package nvmet provisions NVMe over Fabrics targets through the kernel's
+// nvmet configfs tree, the same subsystems, namespaces, ports and hosts
+// that docs/nvme.md builds by hand.
+//
+// Configfs creates an item's attribute files and default groups itself when
+// the item's directory is made, and removes them with it. Target makes the
+// default groups and removes leftover attribute files on its own as well,
+// so it works the same against a plain directory.
+package nvmet
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DefaultRoot is where the nvmet configfs tree is mounted.
+const DefaultRoot = "/sys/kernel/config/nvmet"
+
+var (
+	// ErrNotFound is returned when a subsystem, namespace or port doesn't
+	// exist.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidName is returned for a subsystem or host NQN that can't name
+	// a configfs item.
+	ErrInvalidName = errors.New("invalid name")
+)
+
+// Target is the nvmet target on this machine.
+type Target struct {
+	// Root is the nvmet configfs directory, normally DefaultRoot.
+	Root string
+}
+
+// NewTarget returns a Target using the real configfs tree.
+func NewTarget() *Target {
+	return &Target{Root: DefaultRoot}
+}
+
+func (t *Target) subsystemDir(nqn string) string {
+	return filepath.Join(t.Root, "subsystems", nqn)
+}
+
+func (t *Target) hostDir(hostNQN string) string {
+	return filepath.Join(t.Root, "hosts", hostNQN)
+}
+
+func (t *Target) portDir(id int) string {
+	return filepath.Join(t.Root, "ports", strconv.Itoa(id))
+}
+
+// Subsystems returns the NQNs of all subsystems, sorted.
+func (t *Target) Subsystems() ([]string, error) {
+	nqns, err := readDirNames(filepath.Join(t.Root, "subsystems"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return nqns, err
+}
+
+// CreateSubsystem creates the subsystem if it doesn't exist. Only hosts
+// added with AllowHost may connect to it.
+func (t *Target) CreateSubsystem(nqn string) error {
+	if err := checkName(nqn); err != nil {
+		return err
+	}
+	dir := t.subsystemDir(nqn)
+	if err := mkdir(dir); err != nil {
+		return err
+	}
+	for _, group := range []string{"namespaces", "allowed_hosts"} {
+		if err := mkdir(filepath.Join(dir, group)); err != nil {
+			return err
+		}
+	}
+	return writeAttr(filepath.Join(dir, "attr_allow_any_host"), "0")
+}
+
+// DeleteSubsystem stops exporting the subsystem on every port, and removes
+// it along with its namespaces and host grants. Hosts no other subsystem
+// allows are removed too. Deleting a missing subsystem succeeds.
+func (t *Target) DeleteSubsystem(nqn string) error {
+	if err := checkName(nqn); err != nil {
+		return err
+	}
+	dir := t.subsystemDir(nqn)
+	if _, err := os.Lstat(dir); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	ports, err := t.Ports()
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		if err := t.UnexportSubsystem(p.ID, nqn); err != nil {
+			return err
+		}
+	}
+	if err := t.SetAllowedHosts(nqn, nil); err != nil {
+		return err
+	}
+	namespaces, err := t.Namespaces(nqn)
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		if err := t.RemoveNamespace(nqn, ns.NSID); err != nil {
+			return err
+		}
+	}
+	return removeItem(dir)
+}
+
+// Namespace is a namespace of a subsystem, backed by a block device or a
+// regular file.
+type Namespace struct {
+	NSID int
+	// DevicePath is the block device or file holding the namespace's data.
+	DevicePath string
+	// UUID is reported to hosts as the namespace UUID and, without dashes,
+	// as its NGUID. The kernel picks one when empty.
+	UUID    string
+	Enabled bool
+}
+
+// Namespaces returns the subsystem's namespaces, ordered by NSID.
+func (t *Target) Namespaces(nqn string) ([]Namespace, error) {
+	names, err := readDirNames(filepath.Join(t.subsystemDir(nqn), "namespaces"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var namespaces []Namespace
+	for _, name := range names {
+		nsid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		ns, err := t.Namespace(nqn, nsid)
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, ns)
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].NSID < namespaces[j].NSID
+	})
+	return namespaces, nil
+}
+
+// Namespace returns a namespace of the subsystem, or ErrNotFound.
+func (t *Target) Namespace(nqn string, nsid int) (Namespace, error) {
+	dir := t.namespaceDir(nqn, nsid)
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return Namespace{}, ErrNotFound
+	} else if err != nil {
+		return Namespace{}, err
+	}
+	return Namespace{
+		NSID:       nsid,
+		DevicePath: readAttr(filepath.Join(dir, "device_path")),
+		UUID:       readAttr(filepath.Join(dir, "device_uuid")),
+		Enabled:    readAttr(filepath.Join(dir, "enable")) == "1",
+	}, nil
+}
+
+func (t *Target) namespaceDir(nqn string, nsid int) string {
+	return filepath.Join(t.subsystemDir(nqn), "namespaces", strconv.Itoa(nsid))
+}
+
+// SetNamespace creates or reconfigures a namespace of an existing subsystem
+// and enables it. A namespace that already matches is left alone, so hosts
+// using it aren't disturbed.
+func (t *Target) SetNamespace(nqn string, ns Namespace) error {
+	if err := checkName(nqn); err != nil {
+		return err
+	}
+	if _, err := os.Stat(t.subsystemDir(nqn)); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	current, err := t.Namespace(nqn, ns.NSID)
+	if err == nil && current.Enabled && current.DevicePath == ns.DevicePath &&
+		(ns.UUID == "" || strings.EqualFold(current.UUID, ns.UUID)) {
+		return nil
+	} else if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	dir := t.namespaceDir(nqn, ns.NSID)
+	if err := mkdir(dir); err != nil {
+		return err
+	}
+	// The device and identifiers can only be changed while disabled.
+	if current.Enabled {
+		if err := writeAttr(filepath.Join(dir, "enable"), "0"); err != nil {
+			return err
+		}
+	}
+	if err := writeAttr(filepath.Join(dir, "device_path"), ns.DevicePath); err != nil {
+		return err
+	}
+	if ns.UUID != "" {
+		if err := writeAttr(filepath.Join(dir, "device_uuid"), ns.UUID); err != nil {
+			return err
+		}
+		if err := writeAttr(filepath.Join(dir, "device_nguid"), ns.UUID); err != nil {
+			return err
+		}
+	}
+	return writeAttr(filepath.Join(dir, "enable"), "1")
+}
+
+// RevalidateNamespace makes the target pick up a new size of the device
+// backing the namespace, and tell connected hosts about it.
+func (t *Target) RevalidateNamespace(nqn string, nsid int) error {
+	dir := t.namespaceDir(nqn, nsid)
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return writeAttr(filepath.Join(dir, "revalidate_size"), "1")
+}
+
+// RemoveNamespace disables and removes a namespace. Removing a missing
+// namespace succeeds.
+func (t *Target) RemoveNamespace(nqn string, nsid int) error {
+	dir := t.namespaceDir(nqn, nsid)
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if readAttr(filepath.Join(dir, "enable")) == "1" {
+		if err := writeAttr(filepath.Join(dir, "enable"), "0"); err != nil {
+			return err
+		}
+	}
+	return removeItem(dir)
+}
+
+// AllowedHosts returns the host NQNs allowed to connect to the subsystem,
+// sorted.
+func (t *Target) AllowedHosts(nqn string) ([]string, error) {
+	hosts, err := readDirNames(filepath.Join(t.subsystemDir(nqn), "allowed_hosts"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return hosts, err
+}
+
+// AllowHost lets the host connect to the subsystem.
+func (t *Target) AllowHost(nqn, hostNQN string) error {
+	if err := checkName(nqn); err != nil {
+		return err
+	}
+	if err := checkName(hostNQN); err != nil {
+		return err
+	}
+	if _, err := os.Stat(t.subsystemDir(nqn)); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err := mkdir(t.hostDir(hostNQN)); err != nil {
+		return err
+	}
+	return symlink(t.hostDir(hostNQN), filepath.Join(t.subsystemDir(nqn), "allowed_hosts", hostNQN))
+}
+
+// DisallowHost stops the host from connecting to the subsystem. Hosts
+// already connected keep their connection. The host is removed altogether
+// once no subsystem allows it.
+func (t *Target) DisallowHost(nqn, hostNQN string) error {
+	if err := checkName(nqn); err != nil {
+		return err
+	}
+	if err := checkName(hostNQN); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(t.subsystemDir(nqn), "allowed_hosts", hostNQN))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return t.removeHostIfUnused(hostNQN)
+}
+
+// SetAllowedHosts makes hosts the exact set of hosts allowed to connect to
+// the subsystem.
+func (t *Target) SetAllowedHosts(nqn string, hosts []string) error {
+	current, err := t.AllowedHosts(nqn)
+	if err != nil {
+		return err
+	}
+	for _, h := range current {
+		if !contains(hosts, h) {
+			if err := t.DisallowHost(nqn, h); err != nil {
+				return err
+			}
+		}
+	}
+	for _, h := range hosts {
+		if !contains(current, h) {
+			if err := t.AllowHost(nqn, h); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Target) removeHostIfUnused(hostNQN string) error {
+	subsystems, err := t.Subsystems()
+	if err != nil {
+		return err
+	}
+	for _, nqn := range subsystems {
+		if _, err := os.Lstat(filepath.Join(t.subsystemDir(nqn), "allowed_hosts", hostNQN)); err == nil {
+			return nil
+		}
+	}
+	err = removeItem(t.hostDir(hostNQN))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// checkName rejects subsystem and host NQNs that aren't a single path
+// element. An empty one would otherwise make Target write the item's
+// attributes into the group above it.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("%w %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readDirNames returns the names in a directory, sorted.
+func readDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+// readAttr returns the trimmed contents of an attribute file, or "" if it
+// can't be read.
+func readAttr(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// writeAttr writes an attribute file.
+func writeAttr(path, value string) error {
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("writing %q to %s: %w", value, path, err)
+	}
+	return nil
+}
+
+// mkdir creates a configfs item or group, succeeding if it exists. The
+// top level groups always exist in configfs, but not in a plain directory.
+func mkdir(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+// symlink links a configfs item into another, succeeding if the link exists.
+func symlink(target, link string) error {
+	err := os.Symlink(target, link)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+// removeItem removes a configfs item. Configfs takes the attribute files and
+// default groups with it; in a plain directory those are removed first.
+func removeItem(path string) error {
+	err := os.Remove(path)
+	if !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(path, e.Name())
+		if e.IsDir() {
+			err = removeItem(p)
+		} else {
+			err = os.Remove(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
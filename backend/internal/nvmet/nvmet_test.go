@@ -0,0 +1,213 @@
+package nvmet
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	nqn1  = "nqn.2024-02.com.example.csi:1"
+	nqn2  = "nqn.2024-02.com.example.csi:2"
+	host1 = "nqn.2014-08.org.nvmexpress:uuid:1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+	host2 = "nqn.2014-08.org.nvmexpress:uuid:2c4e28ba-2fa1-11d2-883f-0016d3cca427"
+)
+
+func newTarget(t *testing.T) *Target {
+	return &Target{Root: t.TempDir()}
+}
+
+// exists reports whether path exists, without following a final symlink.
+func exists(t *testing.T, path string) bool {
+	t.Helper()
+	_, err := os.Lstat(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func mustCreateSubsystem(t *testing.T, target *Target, nqn string) {
+	t.Helper()
+	if err := target.CreateSubsystem(nqn); err != nil {
+		t.Fatalf("CreateSubsystem(%q): %v", nqn, err)
+	}
+}
+
+func TestCreateSubsystem(t *testing.T) {
+	target := newTarget(t)
+	// Creating it again changes nothing.
+	for i := 0; i < 2; i++ {
+		mustCreateSubsystem(t, target, nqn1)
+	}
+	dir := target.subsystemDir(nqn1)
+	for _, group := range []string{"namespaces", "allowed_hosts"} {
+		if !exists(t, filepath.Join(dir, group)) {
+			t.Errorf("group %s not created", group)
+		}
+	}
+	if got := readAttr(filepath.Join(dir, "attr_allow_any_host")); got != "0" {
+		t.Errorf("attr_allow_any_host = %q, want 0", got)
+	}
+	subsystems, err := target.Subsystems()
+	if err != nil || !reflect.DeepEqual(subsystems, []string{nqn1}) {
+		t.Errorf("Subsystems() = %v, %v, want [%s]", subsystems, err, nqn1)
+	}
+}
+
+func TestCreateSubsystemInvalidName(t *testing.T) {
+	target := newTarget(t)
+	for _, nqn := range []string{"", ".", "..", "nqn.a/b"} {
+		if err := target.CreateSubsystem(nqn); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("CreateSubsystem(%q) error = %v, want ErrInvalidName", nqn, err)
+		}
+		if err := target.DeleteSubsystem(nqn); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("DeleteSubsystem(%q) error = %v, want ErrInvalidName", nqn, err)
+		}
+	}
+	// Nothing may have been written into the top level groups.
+	for _, path := range []string{"attr_allow_any_host", "subsystems/attr_allow_any_host", "subsystems/namespaces"} {
+		if exists(t, filepath.Join(target.Root, path)) {
+			t.Errorf("%s was created", path)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	target := newTarget(t)
+	ns := Namespace{NSID: 1, DevicePath: "/dev/vg/vol1", UUID: "1b4e28ba-2fa1-11d2-883f-0016d3cca427"}
+	if err := target.SetNamespace(nqn1, ns); err != ErrNotFound {
+		t.Errorf("SetNamespace() on a missing subsystem error = %v, want ErrNotFound", err)
+	}
+	mustCreateSubsystem(t, target, nqn1)
+	if err := target.SetNamespace(nqn1, ns); err != nil {
+		t.Fatal(err)
+	}
+	dir := target.namespaceDir(nqn1, 1)
+	if got := readAttr(filepath.Join(dir, "device_nguid")); got != ns.UUID {
+		t.Errorf("device_nguid = %q, want %q", got, ns.UUID)
+	}
+	ns.Enabled = true
+	got, err := target.Namespaces(nqn1)
+	if err != nil || !reflect.DeepEqual(got, []Namespace{ns}) {
+		t.Errorf("Namespaces() = %+v, %v, want [%+v]", got, err, ns)
+	}
+
+	// A namespace that already matches isn't rewritten.
+	sentinel := filepath.Join(dir, "device_path")
+	if err := os.WriteFile(filepath.Join(dir, "enable"), []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(sentinel)
+	if err := target.SetNamespace(nqn1, Namespace{NSID: 1, DevicePath: ns.DevicePath}); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat(sentinel); !after.ModTime().Equal(info.ModTime()) {
+		t.Error("SetNamespace() rewrote a namespace that already matched")
+	}
+
+	// A different device reconfigures it.
+	if err := target.SetNamespace(nqn1, Namespace{NSID: 1, DevicePath: "/dev/vg/vol1-new"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := target.Namespace(nqn1, 1); got.DevicePath != "/dev/vg/vol1-new" || !got.Enabled {
+		t.Errorf("Namespace() after reconfiguring = %+v", got)
+	}
+
+	if err := target.RevalidateNamespace(nqn1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAttr(filepath.Join(dir, "revalidate_size")); got != "1" {
+		t.Errorf("revalidate_size = %q, want 1", got)
+	}
+	if err := target.RevalidateNamespace(nqn1, 2); err != ErrNotFound {
+		t.Errorf("RevalidateNamespace() of a missing namespace error = %v, want ErrNotFound", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := target.RemoveNamespace(nqn1, 1); err != nil {
+			t.Fatalf("RemoveNamespace() #%d: %v", i+1, err)
+		}
+	}
+	if _, err := target.Namespace(nqn1, 1); err != ErrNotFound {
+		t.Errorf("Namespace() after removing error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	target := newTarget(t)
+	if err := target.AllowHost(nqn1, host1); err != ErrNotFound {
+		t.Errorf("AllowHost() on a missing subsystem error = %v, want ErrNotFound", err)
+	}
+	mustCreateSubsystem(t, target, nqn1)
+	mustCreateSubsystem(t, target, nqn2)
+	for i := 0; i < 2; i++ {
+		if err := target.AllowHost(nqn1, host1); err != nil {
+			t.Fatalf("AllowHost() #%d: %v", i+1, err)
+		}
+	}
+	if err := target.AllowHost(nqn2, host1); err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Readlink(filepath.Join(target.subsystemDir(nqn1), "allowed_hosts", host1))
+	if err != nil || link != target.hostDir(host1) {
+		t.Errorf("allowed_hosts link = %q, %v, want %q", link, err, target.hostDir(host1))
+	}
+
+	if err := target.SetAllowedHosts(nqn1, []string{host2}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := target.AllowedHosts(nqn1); err != nil || !reflect.DeepEqual(got, []string{host2}) {
+		t.Errorf("AllowedHosts() = %v, %v, want [%s]", got, err, host2)
+	}
+	// host1 is still allowed by the other subsystem.
+	if !exists(t, target.hostDir(host1)) {
+		t.Error("host removed while another subsystem allows it")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := target.DisallowHost(nqn2, host1); err != nil {
+			t.Fatalf("DisallowHost() #%d: %v", i+1, err)
+		}
+	}
+	if exists(t, target.hostDir(host1)) {
+		t.Error("host kept after no subsystem allows it")
+	}
+	if err := target.AllowHost(nqn1, ""); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("AllowHost() of an empty host error = %v, want ErrInvalidName", err)
+	}
+}
+
+func TestDeleteSubsystem(t *testing.T) {
+	target := newTarget(t)
+	mustCreateSubsystem(t, target, nqn1)
+	if err := target.SetNamespace(nqn1, Namespace{NSID: 1, DevicePath: "/dev/vg/vol1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.AllowHost(nqn1, host1); err != nil {
+		t.Fatal(err)
+	}
+	port, err := target.EnsurePort(Port{Transport: "tcp", Address: "192.168.0.107", ServiceID: "4420"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.ExportSubsystem(port.ID, nqn1); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := target.DeleteSubsystem(nqn1); err != nil {
+			t.Fatalf("DeleteSubsystem() #%d: %v", i+1, err)
+		}
+	}
+	for _, path := range []string{target.subsystemDir(nqn1), target.hostDir(host1)} {
+		if exists(t, path) {
+			t.Errorf("%s left behind", path)
+		}
+	}
+	if nqns, err := target.PortSubsystems(port.ID); err != nil || len(nqns) != 0 {
+		t.Errorf("PortSubsystems() = %v, %v, want none", nqns, err)
+	}
+}
@@ -0,0 +1,156 @@
+package nvmet
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Port is a transport address subsystems are exported on.
+type Port struct {
+	ID int
+	// Transport is "tcp", "rdma" or "loop".
+	Transport string
+	// Family is "ipv4" or "ipv6", derived from the address when empty.
+	Family    string
+	Address   string
+	ServiceID string
+}
+
+// Ports returns every port, ordered by ID.
+func (t *Target) Ports() ([]Port, error) {
+	names, err := readDirNames(filepath.Join(t.Root, "ports"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ports []Port
+	for _, name := range names {
+		id, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		p, err := t.Port(id)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, p)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].ID < ports[j].ID
+	})
+	return ports, nil
+}
+
+// Port returns the port with the given ID, or ErrNotFound.
+func (t *Target) Port(id int) (Port, error) {
+	dir := t.portDir(id)
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return Port{}, ErrNotFound
+	} else if err != nil {
+		return Port{}, err
+	}
+	return Port{
+		ID:        id,
+		Transport: readAttr(filepath.Join(dir, "addr_trtype")),
+		Family:    readAttr(filepath.Join(dir, "addr_adrfam")),
+		Address:   readAttr(filepath.Join(dir, "addr_traddr")),
+		ServiceID: readAttr(filepath.Join(dir, "addr_trsvcid")),
+	}, nil
+}
+
+// EnsurePort returns the port listening on p's transport address, creating
+// it with the next free ID if there is none. p.ID is ignored.
+func (t *Target) EnsurePort(p Port) (Port, error) {
+	if p.Family == "" {
+		p.Family = "ipv4"
+		if ip := net.ParseIP(p.Address); ip != nil && ip.To4() == nil {
+			p.Family = "ipv6"
+		}
+	}
+	ports, err := t.Ports()
+	if err != nil {
+		return Port{}, err
+	}
+	next := 1
+	for _, existing := range ports {
+		if existing.Transport == p.Transport && existing.Address == p.Address && existing.ServiceID == p.ServiceID {
+			return existing, nil
+		}
+		if existing.ID >= next {
+			next = existing.ID + 1
+		}
+	}
+
+	p.ID = next
+	dir := t.portDir(p.ID)
+	if err := mkdir(dir); err != nil {
+		return Port{}, err
+	}
+	if err := mkdir(filepath.Join(dir, "subsystems")); err != nil {
+		return Port{}, err
+	}
+	// A port is enabled, and starts listening, once its first subsystem is
+	// linked, so every attribute is set by then.
+	for _, attr := range []struct{ name, value string }{
+		{"addr_trtype", p.Transport},
+		{"addr_adrfam", p.Family},
+		{"addr_traddr", p.Address},
+		{"addr_trsvcid", p.ServiceID},
+	} {
+		if err := writeAttr(filepath.Join(dir, attr.name), attr.value); err != nil {
+			return Port{}, err
+		}
+	}
+	return p, nil
+}
+
+// RemovePort removes a port that exports no subsystems. Removing a missing
+// port succeeds.
+func (t *Target) RemovePort(id int) error {
+	dir := t.portDir(id)
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return removeItem(dir)
+}
+
+// PortSubsystems returns the NQNs of the subsystems exported on the port,
+// sorted.
+func (t *Target) PortSubsystems(id int) ([]string, error) {
+	nqns, err := readDirNames(filepath.Join(t.portDir(id), "subsystems"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return nqns, err
+}
+
+// ExportSubsystem makes the subsystem reachable through the port.
+func (t *Target) ExportSubsystem(id int, nqn string) error {
+	if err := checkName(nqn); err != nil {
+		return err
+	}
+	if _, err := os.Stat(t.portDir(id)); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if _, err := os.Stat(t.subsystemDir(nqn)); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return symlink(t.subsystemDir(nqn), filepath.Join(t.portDir(id), "subsystems", nqn))
+}
+
+// UnexportSubsystem stops exporting the subsystem through the port, which
+// drops the connections hosts have to it there. Unexporting a subsystem
+// that isn't exported succeeds.
+func (t *Target) UnexportSubsystem(id int, nqn string) error {
+	err := os.Remove(filepath.Join(t.portDir(id), "subsystems", nqn))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package nvmet
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnsurePort(t *testing.T) {
+	target := newTarget(t)
+	tcp4 := Port{Transport: "tcp", Address: "192.168.0.107", ServiceID: "4420"}
+	first, err := target.EnsurePort(tcp4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Port{ID: 1, Transport: "tcp", Family: "ipv4", Address: "192.168.0.107", ServiceID: "4420"}
+	if first != want {
+		t.Errorf("EnsurePort() = %+v, want %+v", first, want)
+	}
+	if got, err := target.Port(1); err != nil || got != want {
+		t.Errorf("Port(1) = %+v, %v, want %+v", got, err, want)
+	}
+
+	// The same address reuses the port.
+	again, err := target.EnsurePort(tcp4)
+	if err != nil || again != want {
+		t.Errorf("EnsurePort() again = %+v, %v, want %+v", again, err, want)
+	}
+
+	second, err := target.EnsurePort(Port{Transport: "tcp", Address: "fd00::1", ServiceID: "4420"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != 2 || second.Family != "ipv6" {
+		t.Errorf("EnsurePort() of a new address = %+v, want ID 2 and family ipv6", second)
+	}
+	ports, err := target.Ports()
+	if err != nil || !reflect.DeepEqual(ports, []Port{want, second}) {
+		t.Errorf("Ports() = %+v, %v", ports, err)
+	}
+}
+
+func TestExportSubsystem(t *testing.T) {
+	target := newTarget(t)
+	port, err := target.EnsurePort(Port{Transport: "tcp", Address: "192.168.0.107", ServiceID: "4420"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.ExportSubsystem(port.ID, nqn1); err != ErrNotFound {
+		t.Errorf("ExportSubsystem() of a missing subsystem error = %v, want ErrNotFound", err)
+	}
+	mustCreateSubsystem(t, target, nqn1)
+	if err := target.ExportSubsystem(port.ID+1, nqn1); err != ErrNotFound {
+		t.Errorf("ExportSubsystem() on a missing port error = %v, want ErrNotFound", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := target.ExportSubsystem(port.ID, nqn1); err != nil {
+			t.Fatalf("ExportSubsystem() #%d: %v", i+1, err)
+		}
+	}
+	link, err := os.Readlink(filepath.Join(target.portDir(port.ID), "subsystems", nqn1))
+	if err != nil || link != target.subsystemDir(nqn1) {
+		t.Errorf("port subsystems link = %q, %v, want %q", link, err, target.subsystemDir(nqn1))
+	}
+	if nqns, err := target.PortSubsystems(port.ID); err != nil || !reflect.DeepEqual(nqns, []string{nqn1}) {
+		t.Errorf("PortSubsystems() = %v, %v, want [%s]", nqns, err, nqn1)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := target.UnexportSubsystem(port.ID, nqn1); err != nil {
+			t.Fatalf("UnexportSubsystem() #%d: %v", i+1, err)
+		}
+	}
+	if nqns, err := target.PortSubsystems(port.ID); err != nil || len(nqns) != 0 {
+		t.Errorf("PortSubsystems() after unexporting = %v, %v, want none", nqns, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := target.RemovePort(port.ID); err != nil {
+			t.Fatalf("RemovePort() #%d: %v", i+1, err)
+		}
+	}
+	if _, err := target.Port(port.ID); err != ErrNotFound {
+		t.Errorf("Port() after removing error = %v, want ErrNotFound", err)
+	}
+	if _, err := target.PortSubsystems(port.ID); err != ErrNotFound {
+		t.Errorf("PortSubsystems() of a removed port error = %v, want ErrNotFound", err)
+	}
+}
@@ -1,30 +1,167 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 
 	"example.com/csiproject/backend/internal/api"
 	"example.com/csiproject/backend/internal/db"
+	"example.com/csiproject/backend/internal/engine"
+	"example.com/csiproject/backend/internal/nvmet"
 	"example.com/csiproject/backend/model"
 )
 
+// config is the layout of the optional backend config file.
+type config struct {
+	// Engine names the storage engine that allocates volume space, and
+	// EngineOptions configures it. Without one, volumes are only recorded.
+	Engine        string            `json:"engine"`
+	EngineOptions map[string]string `json:"engineOptions"`
+}
+
 func main() {
 	// Allow user to specify listen port on command line
 	var port int
+	var usersFile, tokensFile string
+	var tlsCert, tlsKey, tlsClientCA string
+	var dbBackend, dbPath string
+	var nvmetRoot string
+	var configFile string
 	flag.IntVar(&port, "port", 10000, "port to listen on")
+	flag.StringVar(&dbBackend, "backend", "memory", "where volume records are kept: memory or bolt")
+	flag.StringVar(&dbPath, "db-path", "/var/lib/csi-backend/volumes.db", "database file for the bolt backend")
+	flag.StringVar(&configFile, "config", "", "JSON config file selecting the storage engine")
+	flag.StringVar(&nvmetRoot, "nvmet-root", "", "nvmet configfs directory, normally "+nvmet.DefaultRoot+", to provision NVMe-oF targets in; when empty volumes are only recorded")
+	flag.StringVar(&usersFile, "users-file", "", "file of username:password lines allowed to use the API")
+	flag.StringVar(&tokensFile, "tokens-file", "", "file of bearer API tokens allowed to use the API, one per line")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate to serve HTTPS with")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM key for -tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "PEM bundle of CAs; when set, clients must present a certificate signed by one (mutual TLS)")
 	flag.Parse()
 
-	// Create in-memory database and add a couple of test volumes
-	db := db.NewMemoryDatabase()
-	db.AddVolume(model.Volume{ID: "1", Name: "volume-1", Hostport: "192.168.0.107:4400", Size: "1G"})
-	db.AddVolume(model.Volume{ID: "2", Name: "volume-2", Hostport: "192.168.0.107:5400", Size: "2G"})
+	var database db.Database
+	switch dbBackend {
+	case "memory":
+		// Create in-memory database and add a couple of test volumes
+		memory := db.NewMemoryDatabase()
+		memory.AddVolume(model.Volume{ID: "1", Name: "volume-1", Hostport: "192.168.0.107:4400", Size: "1G", SubsystemNQN: api.SubsystemNQN("1")})
+		memory.AddVolume(model.Volume{ID: "2", Name: "volume-2", Hostport: "192.168.0.107:5400", Size: "2G", SubsystemNQN: api.SubsystemNQN("2")})
+		database = memory
+	case "bolt":
+		bolt, err := db.NewBoltDatabase(dbPath)
+		if err != nil {
+			log.Fatalf("opening database %s: %v", dbPath, err)
+		}
+		defer bolt.Close()
+		database = bolt
+	default:
+		log.Fatalf("unknown -backend %q, expected memory or bolt", dbBackend)
+	}
 
 	// Create server and wire up database
-	server := api.NewServer(db, log.Default())
+	server := api.NewServer(database, log.Default())
+	if configFile != "" {
+		cfg, err := readConfig(configFile)
+		if err != nil {
+			log.Fatalf("reading config %s: %v", configFile, err)
+		}
+		if cfg.Engine != "" {
+			e, err := engine.New(cfg.Engine, cfg.EngineOptions)
+			if err != nil {
+				log.Fatal(err)
+			}
+			server.UseEngine(e)
+			log.Printf("allocating volumes with the %s engine", cfg.Engine)
+		}
+	}
+	if nvmetRoot != "" {
+		server.UseTarget(&nvmet.Target{Root: nvmetRoot})
+	} else {
+		log.Printf("no -nvmet-root given, volumes are not exported")
+	}
+	if err := server.AbandonProvisioning(context.Background()); err != nil {
+		log.Printf("error removing volumes left half provisioned: %v", err)
+	}
+
+	if usersFile != "" || tokensFile != "" {
+		var users map[string]string
+		var tokens []string
+		var err error
+		if usersFile != "" {
+			if users, err = api.ReadUsersFile(usersFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if tokensFile != "" {
+			if tokens, err = api.ReadTokensFile(tokensFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		server.RequireAuth(api.NewAuthenticator(users, tokens))
+	} else {
+		log.Printf("no -users-file or -tokens-file given, the API is unauthenticated")
+	}
+
+	httpServer := &http.Server{
+		Addr:    ":" + strconv.Itoa(port),
+		Handler: server,
+	}
+
+	if tlsCert == "" {
+		if tlsClientCA != "" {
+			log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+		}
+		log.Printf("listening on http://localhost:%d", port)
+		log.Fatal(httpServer.ListenAndServe())
+	}
+
+	tlsConfig, err := serverTLSConfig(tlsClientCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpServer.TLSConfig = tlsConfig
+	log.Printf("listening on https://localhost:%d", port)
+	log.Fatal(httpServer.ListenAndServeTLS(tlsCert, tlsKey))
+}
+
+// readConfig loads the backend config file.
+func readConfig(path string) (config, error) {
+	var cfg config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg)
+	return cfg, err
+}
 
-	log.Printf("listening on http://localhost:%d", port)
-	http.ListenAndServe(":"+strconv.Itoa(port), server)
+// serverTLSConfig returns the TLS configuration to serve with. When
+// clientCA is set, clients must present a certificate signed by it.
+func serverTLSConfig(clientCA string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCA == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCA)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
 }
@@ -0,0 +1,12 @@
+package model
+
+// Keys of the volume context, and later the publish context, that tell the
+// node plugin how to reach a volume over NVMe-oF.
+const (
+	ContextTransport    = "transport"
+	ContextAddress      = "address"
+	ContextPort         = "port"
+	ContextSubsystemNQN = "subsystemNQN"
+	// ContextNamespaceUUID holds the volume's NamespaceUUID.
+	ContextNamespaceUUID = "namespaceUUID"
+)
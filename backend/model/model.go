@@ -6,4 +6,28 @@ type Volume struct {
 	Path     string `json:"path"`
 	Size     string `json:"size"`
 	Hostport string `json:"hostport"`
+
+	// SubsystemNQN is the NVMe subsystem the volume is exported as.
+	SubsystemNQN string `json:"subsystem_nqn,omitempty"`
+	// NamespaceUUID identifies the volume's namespace. It is reported by the
+	// namespace as its UUID and, without dashes, its NGUID, so hosts can
+	// find the namespace whatever device name it gets.
+	NamespaceUUID string `json:"namespace_uuid,omitempty"`
+	// AllowedHosts are the host NQNs allowed to connect to the subsystem.
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+
+	// CapacityBytes is the capacity the backend actually allocated, which
+	// may be larger than the requested Size.
+	CapacityBytes int64 `json:"capacity_bytes,omitempty"`
+	// SourceSnapshotID or SourceVolumeID, at most one of which is set, is
+	// the snapshot or volume whose contents the volume was created with.
+	SourceSnapshotID string `json:"source_snapshot_id,omitempty"`
+	SourceVolumeID   string `json:"source_volume_id,omitempty"`
+	// Parameters are the StorageClass parameters the volume was created with.
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// Context is handed back to the CO as the CSI volume context.
+	Context map[string]string `json:"context,omitempty"`
+	// Provisioning is set while the backend is still allocating and
+	// exporting the volume's space. The volume can't be used until then.
+	Provisioning bool `json:"provisioning,omitempty"`
 }
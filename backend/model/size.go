@@ -0,0 +1,44 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits maps the suffixes accepted by ParseSize to their multipliers.
+// Single letter suffixes are binary to match what the backend has always
+// allocated for sizes like "1G".
+var sizeUnits = map[string]int64{
+	"":   1,
+	"K":  1 << 10,
+	"Ki": 1 << 10,
+	"M":  1 << 20,
+	"Mi": 1 << 20,
+	"G":  1 << 30,
+	"Gi": 1 << 30,
+	"T":  1 << 40,
+	"Ti": 1 << 40,
+}
+
+// ParseSize converts a volume size such as "1G", "512Mi" or "1073741824"
+// into a number of bytes.
+func ParseSize(size string) (int64, error) {
+	s := strings.TrimSpace(size)
+	i := len(s)
+	for i > 0 && (s[i-1] < '0' || s[i-1] > '9') {
+		i--
+	}
+	multiplier, ok := sizeUnits[s[i:]]
+	if !ok || i == 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	if n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("size %q too large", size)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+// Snapshot is a point in time copy of a volume.
+type Snapshot struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// SourceVolumeID is the volume the snapshot was taken of.
+	SourceVolumeID string `json:"source_volume_id"`
+	// SizeBytes is the size of the volume when the snapshot was taken, the
+	// smallest size a volume restored from it can have.
+	SizeBytes    int64     `json:"size_bytes"`
+	CreationTime time.Time `json:"creation_time"`
+	// ReadyToUse is set once the snapshot can be restored from.
+	ReadyToUse bool `json:"ready_to_use"`
+}
@@ -5,18 +5,19 @@ go 1.21.6
 require (
 	github.com/container-storage-interface/spec v1.9.0
 	github.com/golang/protobuf v1.5.3
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/sys v0.15.0
 	google.golang.org/grpc v1.61.0
+	google.golang.org/protobuf v1.31.0
 	k8s.io/mount-utils v0.29.1
+	k8s.io/utils v0.0.0-20230726121419-3b25d923346b
 )
 
 require (
 	github.com/go-logr/logr v1.3.0 // indirect
 	github.com/moby/sys/mountinfo v0.6.2 // indirect
 	golang.org/x/net v0.18.0 // indirect
-	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20231106174013-bbf56f31fb17 // indirect
-	google.golang.org/protobuf v1.31.0 // indirect
 	k8s.io/klog/v2 v2.110.1 // indirect
-	k8s.io/utils v0.0.0-20230726121419-3b25d923346b // indirect
 )
@@ -0,0 +1,142 @@
+package nvme
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reController matches the names of NVMe controllers in /sys/class/nvme.
+var reController = regexp.MustCompile(`^nvme(\d+)$`)
+
+// Controller is an NVMe controller known to the kernel.
+type Controller struct {
+	// Name is the controller's name, such as "nvme0".
+	Name         string
+	Instance     int
+	SubsystemNQN string
+	Transport    string
+	// Address and ServiceID are the target's traddr and trsvcid, empty
+	// for PCIe controllers.
+	Address   string
+	ServiceID string
+	// State is the controller state, such as "live" or "connecting".
+	State  string
+	Model  string
+	Serial string
+}
+
+// Controllers returns every NVMe controller, ordered by instance.
+func (h *Host) Controllers() ([]Controller, error) {
+	entries, err := os.ReadDir(filepath.Join(h.SysfsRoot, "class", "nvme"))
+	if os.IsNotExist(err) {
+		// The nvme module isn't loaded, so there are no controllers.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var controllers []Controller
+	for _, e := range entries {
+		if !reController.MatchString(e.Name()) {
+			continue
+		}
+		c, err := h.Controller(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		controllers = append(controllers, c)
+	}
+	sort.Slice(controllers, func(i, j int) bool {
+		return controllers[i].Instance < controllers[j].Instance
+	})
+	return controllers, nil
+}
+
+// Controller returns the controller with the given name, or ErrNotFound.
+func (h *Host) Controller(name string) (Controller, error) {
+	m := reController.FindStringSubmatch(name)
+	if m == nil {
+		return Controller{}, ErrNotFound
+	}
+	dir := h.controllerDir(name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return Controller{}, ErrNotFound
+	} else if err != nil {
+		return Controller{}, err
+	}
+	instance, _ := strconv.Atoi(m[1])
+	c := Controller{
+		Name:         name,
+		Instance:     instance,
+		SubsystemNQN: readAttr(filepath.Join(dir, "subsysnqn")),
+		Transport:    readAttr(filepath.Join(dir, "transport")),
+		State:        readAttr(filepath.Join(dir, "state")),
+		Model:        readAttr(filepath.Join(dir, "model")),
+		Serial:       readAttr(filepath.Join(dir, "serial")),
+	}
+	// The address reads like "traddr=192.168.0.107,trsvcid=4420", possibly
+	// followed by source address fields.
+	for _, field := range strings.Split(readAttr(filepath.Join(dir, "address")), ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "traddr":
+			c.Address = value
+		case "trsvcid":
+			c.ServiceID = value
+		}
+	}
+	return c, nil
+}
+
+// ControllersForSubsystem returns the controllers connected to the
+// subsystem.
+func (h *Host) ControllersForSubsystem(subsystemNQN string) ([]Controller, error) {
+	all, err := h.Controllers()
+	if err != nil {
+		return nil, err
+	}
+	var controllers []Controller
+	for _, c := range all {
+		if c.SubsystemNQN == subsystemNQN {
+			controllers = append(controllers, c)
+		}
+	}
+	return controllers, nil
+}
+
+// Disconnect deletes the controller. A controller that is already gone is
+// not an error.
+func (h *Host) Disconnect(c Controller) error {
+	err := writeAttr(filepath.Join(h.controllerDir(c.Name), "delete_controller"), "1")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// DisconnectSubsystem deletes every controller connected to the subsystem.
+func (h *Host) DisconnectSubsystem(subsystemNQN string) error {
+	controllers, err := h.ControllersForSubsystem(subsystemNQN)
+	if err != nil {
+		return err
+	}
+	for _, c := range controllers {
+		if err := h.Disconnect(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rescan asks the controller to rescan its namespaces, picking up new ones
+// and changed sizes.
+func (h *Host) Rescan(c Controller) error {
+	return writeAttr(filepath.Join(h.controllerDir(c.Name), "rescan_controller"), "1")
+}
+
+func (h *Host) controllerDir(name string) string {
+	return filepath.Join(h.SysfsRoot, "class", "nvme", name)
+}
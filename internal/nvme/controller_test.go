@@ -0,0 +1,65 @@
+package nvme
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestControllers(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"class/nvme/nvme10/subsysnqn": "nqn.2024-01.com.example:vol2\n",
+		"class/nvme/nvme10/transport": "tcp\n",
+		"class/nvme/nvme10/state":     "connecting\n",
+		"class/nvme/nvme10/address":   "traddr=fd00::1,trsvcid=4421,src_addr=fd00::2\n",
+		"class/nvme/nvme2/subsysnqn":  "nqn.2024-01.com.example:vol1\n",
+		"class/nvme/nvme2/transport":  "tcp\n",
+		"class/nvme/nvme2/state":      "live\n",
+		"class/nvme/nvme2/address":    "traddr=192.168.0.107,trsvcid=4420\n",
+		"class/nvme/nvme2/model":      "Linux\n",
+		"class/nvme/nvme2/serial":     "abc123\n",
+		"class/nvme/nvme0/subsysnqn":  "nqn.2014.08.org.nvmexpress:1b36\n",
+		"class/nvme/nvme0/transport":  "pcie\n",
+		"class/nvme/nvme0/address":    "0000:00:04.0\n",
+		// Not a controller.
+		"class/nvme/nvme-fabrics/dev": "10:123\n",
+	})
+	h := &Host{SysfsRoot: root}
+
+	got, err := h.Controllers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Controller{
+		{Name: "nvme0", Instance: 0, SubsystemNQN: "nqn.2014.08.org.nvmexpress:1b36", Transport: "pcie"},
+		{Name: "nvme2", Instance: 2, SubsystemNQN: "nqn.2024-01.com.example:vol1", Transport: "tcp",
+			Address: "192.168.0.107", ServiceID: "4420", State: "live", Model: "Linux", Serial: "abc123"},
+		{Name: "nvme10", Instance: 10, SubsystemNQN: "nqn.2024-01.com.example:vol2", Transport: "tcp",
+			Address: "fd00::1", ServiceID: "4421", State: "connecting"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Controllers() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	forSubsystem, err := h.ControllersForSubsystem("nqn.2024-01.com.example:vol2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forSubsystem) != 1 || forSubsystem[0].Name != "nvme10" {
+		t.Errorf("ControllersForSubsystem() = %+v, want nvme10", forSubsystem)
+	}
+
+	for _, name := range []string{"nvme3", "nvme-fabrics", "sda"} {
+		if _, err := h.Controller(name); err != ErrNotFound {
+			t.Errorf("Controller(%q) error = %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestControllersWithoutNVMeModule(t *testing.T) {
+	h := &Host{SysfsRoot: t.TempDir()}
+	got, err := h.Controllers()
+	if err != nil || len(got) != 0 {
+		t.Errorf("Controllers() = %+v, %v, want none", got, err)
+	}
+}
@@ -0,0 +1,157 @@
+package nvme
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// discoveryLogPage is the log page identifier of the discovery log.
+	discoveryLogPage = 0x70
+	// discoveryLogHeaderSize and discoveryLogEntrySize are fixed by the
+	// NVMe over Fabrics specification.
+	discoveryLogHeaderSize = 1024
+	discoveryLogEntrySize  = 1024
+
+	adminGetLogPage = 0x02
+	// ioctlAdminCmd is NVME_IOCTL_ADMIN_CMD, _IOWR('N', 0x41, struct
+	// nvme_admin_cmd).
+	ioctlAdminCmd = 0xC0484E41
+)
+
+// Subsystem types reported in discovery log entries.
+const (
+	SubsystemTypeReferral  = 1
+	SubsystemTypeNVM       = 2
+	SubsystemTypeDiscovery = 3
+)
+
+// DiscoveryLogEntry is one subsystem port reported by a discovery
+// controller.
+type DiscoveryLogEntry struct {
+	TransportType uint8
+	AddressFamily uint8
+	SubsystemType uint8
+	PortID        uint16
+	ControllerID  uint16
+	ServiceID     string
+	Address       string
+	SubsystemNQN  string
+}
+
+// adminCmd mirrors the kernel's struct nvme_admin_cmd.
+type adminCmd struct {
+	opcode      uint8
+	flags       uint8
+	rsvd1       uint16
+	nsid        uint32
+	cdw2        uint32
+	cdw3        uint32
+	metadata    uint64
+	addr        uint64
+	metadataLen uint32
+	dataLen     uint32
+	cdw10       uint32
+	cdw11       uint32
+	cdw12       uint32
+	cdw13       uint32
+	cdw14       uint32
+	cdw15       uint32
+	timeoutMs   uint32
+	result      uint32
+}
+
+// Discover connects to the discovery controller at the address in o,
+// reads its discovery log and disconnects again. o.SubsystemNQN is ignored.
+func (h *Host) Discover(o ConnectOptions) ([]DiscoveryLogEntry, error) {
+	o.SubsystemNQN = DiscoverySubsystemNQN
+	c, err := h.Connect(o)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Disconnect(c)
+
+	f, err := os.OpenFile(filepath.Join(h.DevRoot, c.Name), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Read the header first to learn how many entries follow.
+	header, err := getLogPage(f, discoveryLogPage, discoveryLogHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	numRecords := binary.LittleEndian.Uint64(header[8:16])
+	page, err := getLogPage(f, discoveryLogPage, discoveryLogHeaderSize+int(numRecords)*discoveryLogEntrySize)
+	if err != nil {
+		return nil, err
+	}
+	return parseDiscoveryLog(page)
+}
+
+// getLogPage reads size bytes of a log page with the Get Log Page admin
+// command.
+func getLogPage(f *os.File, logPage uint8, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	numDwords := uint32(size/4) - 1
+	cmd := adminCmd{
+		opcode:  adminGetLogPage,
+		nsid:    0xffffffff,
+		addr:    uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		dataLen: uint32(size),
+		cdw10:   uint32(logPage) | (numDwords&0xffff)<<16,
+		cdw11:   numDwords >> 16,
+	}
+	// A positive return value is the NVMe status of a failed command.
+	r, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), ioctlAdminCmd, uintptr(unsafe.Pointer(&cmd)))
+	runtime.KeepAlive(buf)
+	if errno != 0 {
+		return nil, fmt.Errorf("get log page 0x%x: %w", logPage, errno)
+	}
+	if r != 0 {
+		return nil, fmt.Errorf("get log page 0x%x: status 0x%x", logPage, r)
+	}
+	return buf, nil
+}
+
+// parseDiscoveryLog decodes a discovery log page.
+func parseDiscoveryLog(page []byte) ([]DiscoveryLogEntry, error) {
+	if len(page) < discoveryLogHeaderSize {
+		return nil, fmt.Errorf("discovery log of %d bytes is shorter than its header", len(page))
+	}
+	numRecords := binary.LittleEndian.Uint64(page[8:16])
+	if uint64(len(page)-discoveryLogHeaderSize)/discoveryLogEntrySize < numRecords {
+		return nil, fmt.Errorf("discovery log of %d bytes is too short for %d entries", len(page), numRecords)
+	}
+	entries := make([]DiscoveryLogEntry, 0, numRecords)
+	for i := 0; i < int(numRecords); i++ {
+		e := page[discoveryLogHeaderSize+i*discoveryLogEntrySize:][:discoveryLogEntrySize]
+		entries = append(entries, DiscoveryLogEntry{
+			TransportType: e[0],
+			AddressFamily: e[1],
+			SubsystemType: e[2],
+			PortID:        binary.LittleEndian.Uint16(e[4:6]),
+			ControllerID:  binary.LittleEndian.Uint16(e[6:8]),
+			ServiceID:     cString(e[32:64]),
+			SubsystemNQN:  cString(e[256:512]),
+			Address:       cString(e[512:768]),
+		})
+	}
+	return entries, nil
+}
+
+// cString converts a NUL or space padded fixed size field to a string.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(bytes.TrimRight(b, " "))
+}
@@ -0,0 +1,90 @@
+package nvme
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// discoveryLog builds a discovery log page holding the entries.
+func discoveryLog(entries ...DiscoveryLogEntry) []byte {
+	page := make([]byte, discoveryLogHeaderSize+len(entries)*discoveryLogEntrySize)
+	binary.LittleEndian.PutUint64(page[0:8], 42) // generation counter
+	binary.LittleEndian.PutUint64(page[8:16], uint64(len(entries)))
+	for i, e := range entries {
+		b := page[discoveryLogHeaderSize+i*discoveryLogEntrySize:]
+		b[0] = e.TransportType
+		b[1] = e.AddressFamily
+		b[2] = e.SubsystemType
+		binary.LittleEndian.PutUint16(b[4:6], e.PortID)
+		binary.LittleEndian.PutUint16(b[6:8], e.ControllerID)
+		// The service ID and address are space padded, the NQN NUL padded.
+		copy(b[32:64], padded(e.ServiceID, 32))
+		copy(b[256:512], e.SubsystemNQN)
+		copy(b[512:768], padded(e.Address, 256))
+	}
+	return page
+}
+
+func padded(s string, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+	return b
+}
+
+func TestParseDiscoveryLog(t *testing.T) {
+	entries := []DiscoveryLogEntry{
+		{
+			TransportType: 3, // tcp
+			AddressFamily: 1, // ipv4
+			SubsystemType: SubsystemTypeNVM,
+			PortID:        1,
+			ControllerID:  0xffff,
+			ServiceID:     "4420",
+			Address:       "192.168.0.107",
+			SubsystemNQN:  "nqn.2024-01.com.example:vol1",
+		},
+		{
+			TransportType: 3,
+			AddressFamily: 2, // ipv6
+			SubsystemType: SubsystemTypeDiscovery,
+			PortID:        2,
+			ControllerID:  0xfffe,
+			ServiceID:     "8009",
+			Address:       "fd00::1",
+			SubsystemNQN:  DiscoverySubsystemNQN,
+		},
+	}
+
+	tests := []struct {
+		name    string
+		page    []byte
+		want    []DiscoveryLogEntry
+		wantErr bool
+	}{
+		{name: "entries", page: discoveryLog(entries...), want: entries},
+		{name: "empty", page: discoveryLog(), want: []DiscoveryLogEntry{}},
+		{name: "short header", page: make([]byte, discoveryLogHeaderSize-1), wantErr: true},
+		{name: "truncated entries", page: discoveryLog(entries...)[:discoveryLogHeaderSize+discoveryLogEntrySize], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDiscoveryLog(tt.page)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseDiscoveryLog() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDiscoveryLog() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package nvme
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DefaultHostNQNFile is where nvme-cli and the kernel tooling keep the
+	// host's NQN.
+	DefaultHostNQNFile = "/etc/nvme/hostnqn"
+	// hostNQNPrefix starts the UUID based NQNs the NVMe spec reserves for
+	// hosts without a naming authority of their own.
+	hostNQNPrefix = "nqn.2014-08.org.nvmexpress:uuid:"
+	// maxNQNLength is the longest NQN the spec allows, in bytes.
+	maxNQNLength = 223
+)
+
+// LoadOrCreateHostNQN returns the host NQN stored in path. If the file
+// doesn't exist a new UUID based NQN is generated and written there, so the
+// host keeps its identity across restarts and matches what nvme-cli uses.
+func LoadOrCreateHostNQN(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		nqn := strings.TrimSpace(string(data))
+		if err := ValidateNQN(nqn); err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+		return nqn, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	nqn, err := NewHostNQN()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	// Write to a temporary file first so a crash can't leave a truncated
+	// NQN behind, and don't replace one written concurrently by someone else.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(nqn+"\n"), 0644); err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, path); errors.Is(err, os.ErrExist) {
+		return LoadOrCreateHostNQN(path)
+	} else if err != nil {
+		return "", err
+	}
+	return nqn, nil
+}
+
+// NewHostNQN generates a random UUID based host NQN.
+func NewHostNQN() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%s%x-%x-%x-%x-%x", hostNQNPrefix, b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// ValidateNQN checks that nqn looks like an NVMe Qualified Name.
+func ValidateNQN(nqn string) error {
+	switch {
+	case !strings.HasPrefix(nqn, "nqn."):
+		return fmt.Errorf("NQN %q does not start with \"nqn.\"", nqn)
+	case len(nqn) > maxNQNLength:
+		return fmt.Errorf("NQN %q is longer than %d bytes", nqn, maxNQNLength)
+	case strings.ContainsAny(nqn, " \t\n,"):
+		// The kernel's connect strings are comma separated.
+		return fmt.Errorf("NQN %q contains whitespace or ','", nqn)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package nvme
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reNamespace matches the block device names of NVMe namespaces, but not
+// the hidden per-path nvmeXcYnZ devices used by native multipathing.
+var reNamespace = regexp.MustCompile(`^nvme\d+n(\d+)$`)
+
+// Namespace is an NVMe namespace exposed as a block device.
+type Namespace struct {
+	// Name is the block device name, such as "nvme0n1".
+	Name         string
+	NSID         int
+	SubsystemNQN string
+	// DevNum is the device's "major:minor" number.
+	DevNum string
+	// SizeBytes is the namespace capacity.
+	SizeBytes int64
+	// Identifiers reported by the namespace, empty when it has none.
+	WWID  string
+	UUID  string
+	NGUID string
+	EUI   string
+}
+
+// Namespaces returns every NVMe namespace block device, ordered by name.
+func (h *Host) Namespaces() ([]Namespace, error) {
+	entries, err := os.ReadDir(filepath.Join(h.SysfsRoot, "block"))
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []Namespace
+	for _, e := range entries {
+		ns, err := h.Namespace(e.Name())
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, ns)
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Name < namespaces[j].Name
+	})
+	return namespaces, nil
+}
+
+// Namespace returns the namespace with the given block device name, or
+// ErrNotFound.
+func (h *Host) Namespace(name string) (Namespace, error) {
+	m := reNamespace.FindStringSubmatch(name)
+	if m == nil {
+		return Namespace{}, ErrNotFound
+	}
+	dir := filepath.Join(h.SysfsRoot, "block", name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return Namespace{}, ErrNotFound
+	} else if err != nil {
+		return Namespace{}, err
+	}
+	nsid, _ := strconv.Atoi(m[1])
+	if v, err := strconv.Atoi(readAttr(filepath.Join(dir, "nsid"))); err == nil {
+		nsid = v
+	}
+	// size is always counted in 512 byte sectors, whatever the block size.
+	sectors, _ := strconv.ParseInt(readAttr(filepath.Join(dir, "size")), 10, 64)
+	return Namespace{
+		Name: name,
+		NSID: nsid,
+		// "device" links to the controller, or to the subsystem when the
+		// kernel multipaths the namespace; both report the subsystem NQN.
+		SubsystemNQN: readAttr(filepath.Join(dir, "device", "subsysnqn")),
+		DevNum:       readAttr(filepath.Join(dir, "dev")),
+		SizeBytes:    sectors * 512,
+		WWID:         readAttr(filepath.Join(dir, "wwid")),
+		UUID:         readAttr(filepath.Join(dir, "uuid")),
+		NGUID:        readAttr(filepath.Join(dir, "nguid")),
+		EUI:          readAttr(filepath.Join(dir, "eui")),
+	}, nil
+}
+
+// NamespacesForSubsystem returns the namespaces of the subsystem.
+func (h *Host) NamespacesForSubsystem(subsystemNQN string) ([]Namespace, error) {
+	all, err := h.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []Namespace
+	for _, ns := range all {
+		if ns.SubsystemNQN == subsystemNQN {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces, nil
+}
+
+// FindNamespace returns the namespace reporting the identifier as its UUID,
+// NGUID, EUI-64 or WWID, or ErrNotFound. The identifier may be given with or
+// without dashes and with a "uuid." or "eui." style prefix.
+func (h *Host) FindNamespace(id string) (Namespace, error) {
+	want := normalizeID(id)
+	if want == "" {
+		return Namespace{}, ErrNotFound
+	}
+	all, err := h.Namespaces()
+	if err != nil {
+		return Namespace{}, err
+	}
+	for _, ns := range all {
+		for _, have := range []string{ns.UUID, ns.NGUID, ns.EUI, ns.WWID} {
+			if normalizeID(have) == want {
+				return ns, nil
+			}
+		}
+	}
+	return Namespace{}, ErrNotFound
+}
+
+// normalizeID reduces a namespace identifier to lower case hex digits, so
+// "uuid.1B4E28BA-2FA1-11D2-883F-0016D3CCA427" matches the uuid attribute
+// "1b4e28ba-2fa1-11d2-883f-0016d3cca427". Identifiers that are all zero
+// mean "not set" and normalize to "".
+func normalizeID(id string) string {
+	if _, rest, ok := strings.Cut(id, "."); ok {
+		id = rest
+	}
+	id = strings.ToLower(strings.ReplaceAll(id, "-", ""))
+	if strings.Trim(id, "0") == "" {
+		return ""
+	}
+	return id
+}
+
+// DevicePath returns the path of the namespace's block device node.
+func (h *Host) DevicePath(ns Namespace) string {
+	return filepath.Join(h.DevRoot, ns.Name)
+}
@@ -0,0 +1,128 @@
+package nvme
+
+import (
+	"fmt"
+	"testing"
+)
+
+// fakeNamespaces is a sysfs block directory with two fabrics namespaces of
+// different subsystems, a PCIe namespace, a hidden multipath path device and
+// a disk that isn't NVMe at all.
+var fakeNamespaces = map[string]string{
+	"block/nvme1n1/nsid":             "1\n",
+	"block/nvme1n1/size":             "2097152\n",
+	"block/nvme1n1/dev":              "259:1\n",
+	"block/nvme1n1/uuid":             "1b4e28ba-2fa1-11d2-883f-0016d3cca427\n",
+	"block/nvme1n1/nguid":            "1b4e28ba2fa111d2883f0016d3cca427\n",
+	"block/nvme1n1/wwid":             "uuid.1b4e28ba-2fa1-11d2-883f-0016d3cca427\n",
+	"block/nvme1n1/device/subsysnqn": "nqn.2024-01.com.example:vol1\n",
+	"block/nvme2n3/nsid":             "3\n",
+	"block/nvme2n3/size":             "4194304\n",
+	"block/nvme2n3/uuid":             "00000000-0000-0000-0000-000000000000\n",
+	"block/nvme2n3/nguid":            "00000000000000000000000000000000\n",
+	"block/nvme2n3/eui":              "00:25:38:8b:91:e8:44:44\n",
+	"block/nvme2n3/wwid":             "eui.0025388b91e84444\n",
+	"block/nvme2n3/device/subsysnqn": "nqn.2024-01.com.example:vol2\n",
+	"block/nvme0n1/size":             "1000\n",
+	"block/nvme0n1/wwid":             "nvme.1b36-6465616462656566-51454d55-00000001\n",
+	"block/nvme0n1/device/subsysnqn": "nqn.2019-08.org.qemu:deadbeef\n",
+	"block/nvme1c1n1/nsid":           "1\n",
+	"block/sda/size":                 "1000\n",
+}
+
+func TestNamespaces(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, fakeNamespaces)
+	h := &Host{SysfsRoot: root, DevRoot: "/dev"}
+
+	got, err := h.Namespaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ns := range got {
+		names = append(names, ns.Name)
+	}
+	if want := "[nvme0n1 nvme1n1 nvme2n3]"; fmt.Sprint(names) != want {
+		t.Errorf("Namespaces() names = %v, want %s", names, want)
+	}
+
+	ns, err := h.Namespace("nvme2n3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.NSID != 3 || ns.SizeBytes != 4194304*512 || ns.SubsystemNQN != "nqn.2024-01.com.example:vol2" {
+		t.Errorf("Namespace(nvme2n3) = %+v", ns)
+	}
+	// Without an nsid attribute the NSID comes from the device name.
+	if ns, err := h.Namespace("nvme0n1"); err != nil || ns.NSID != 1 || ns.SizeBytes != 512000 {
+		t.Errorf("Namespace(nvme0n1) = %+v, %v", ns, err)
+	}
+	for _, name := range []string{"nvme1c1n1", "sda", "nvme5n1"} {
+		if _, err := h.Namespace(name); err != ErrNotFound {
+			t.Errorf("Namespace(%q) error = %v, want ErrNotFound", name, err)
+		}
+	}
+
+	forSubsystem, err := h.NamespacesForSubsystem("nqn.2024-01.com.example:vol1")
+	if err != nil || len(forSubsystem) != 1 || forSubsystem[0].Name != "nvme1n1" {
+		t.Errorf("NamespacesForSubsystem() = %+v, %v, want nvme1n1", forSubsystem, err)
+	}
+	if got := h.DevicePath(forSubsystem[0]); got != "/dev/nvme1n1" {
+		t.Errorf("DevicePath() = %q, want /dev/nvme1n1", got)
+	}
+}
+
+func TestFindNamespace(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, fakeNamespaces)
+	h := &Host{SysfsRoot: root}
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"1b4e28ba-2fa1-11d2-883f-0016d3cca427", "nvme1n1"},
+		{"1B4E28BA-2FA1-11D2-883F-0016D3CCA427", "nvme1n1"},
+		{"uuid.1b4e28ba-2fa1-11d2-883f-0016d3cca427", "nvme1n1"},
+		{"1b4e28ba2fa111d2883f0016d3cca427", "nvme1n1"},
+		{"eui.0025388b91e84444", "nvme2n3"},
+		{"0025388B91E84444", "nvme2n3"},
+		{"nvme.1b36-6465616462656566-51454d55-00000001", "nvme0n1"},
+		// The all zero UUID of nvme2n3 means it has none.
+		{"00000000-0000-0000-0000-000000000000", ""},
+		{"", ""},
+		{"2c4e28ba-2fa1-11d2-883f-0016d3cca427", ""},
+	}
+	for _, tt := range tests {
+		ns, err := h.FindNamespace(tt.id)
+		if tt.want == "" {
+			if err != ErrNotFound {
+				t.Errorf("FindNamespace(%q) = %+v, %v, want ErrNotFound", tt.id, ns, err)
+			}
+			continue
+		}
+		if err != nil || ns.Name != tt.want {
+			t.Errorf("FindNamespace(%q) = %q, %v, want %q", tt.id, ns.Name, err, tt.want)
+		}
+	}
+}
+
+func TestNormalizeID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"1b4e28ba-2fa1-11d2-883f-0016d3cca427", "1b4e28ba2fa111d2883f0016d3cca427"},
+		{"uuid.1B4E28BA-2FA1-11D2-883F-0016D3CCA427", "1b4e28ba2fa111d2883f0016d3cca427"},
+		{"eui.0025388b91e84444", "0025388b91e84444"},
+		{"00000000-0000-0000-0000-000000000000", ""},
+		{"eui.0000000000000000", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeID(tt.id); got != tt.want {
+			t.Errorf("normalizeID(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
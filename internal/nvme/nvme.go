@@ -0,0 +1,146 @@
+// Package nvme manages NVMe over Fabrics connections on a host through the
+// kernel's fabrics interface, without shelling out to nvme-cli.
+//
+// Connections are made by writing connect strings to /dev/nvme-fabrics, and
+// controllers and namespaces are enumerated from sysfs. Both roots are
+// configurable so the package can be exercised against a fake tree.
+package nvme
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DiscoverySubsystemNQN is the well known NQN of discovery controllers.
+	DiscoverySubsystemNQN = "nqn.2014-08.org.nvmexpress.discovery"
+	// DefaultServiceID is the IANA assigned NVMe/TCP port.
+	DefaultServiceID = "4420"
+)
+
+// ErrNotFound is returned when a controller or namespace doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// Host is the NVMe-oF host side of this machine.
+type Host struct {
+	// SysfsRoot is where sysfs is mounted, normally "/sys".
+	SysfsRoot string
+	// DevRoot is where device nodes live, normally "/dev".
+	DevRoot string
+}
+
+// NewHost returns a Host using the real sysfs and /dev.
+func NewHost() *Host {
+	return &Host{SysfsRoot: "/sys", DevRoot: "/dev"}
+}
+
+// ConnectOptions describe a fabrics connection to a subsystem.
+type ConnectOptions struct {
+	// Transport is "tcp", "rdma" or "loop". Defaults to "tcp".
+	Transport string
+	Address   string
+	// ServiceID is the transport service id, the port for TCP. Defaults to
+	// DefaultServiceID.
+	ServiceID    string
+	SubsystemNQN string
+	// HostNQN and HostID identify this host to the target. The kernel uses
+	// its own defaults when they are empty.
+	HostNQN string
+	HostID  string
+	// CtrlLossTimeout is how long, in seconds, the kernel keeps trying to
+	// reconnect a lost controller before removing it. 0 keeps the kernel
+	// default and -1 retries forever.
+	CtrlLossTimeout int
+}
+
+// String returns the options as the connect string the kernel's fabrics
+// driver expects.
+func (o ConnectOptions) String() string {
+	transport := o.Transport
+	if transport == "" {
+		transport = "tcp"
+	}
+	serviceID := o.ServiceID
+	if serviceID == "" {
+		serviceID = DefaultServiceID
+	}
+	opts := []string{
+		"nqn=" + o.SubsystemNQN,
+		"transport=" + transport,
+		"traddr=" + o.Address,
+		"trsvcid=" + serviceID,
+	}
+	if o.HostNQN != "" {
+		opts = append(opts, "hostnqn="+o.HostNQN)
+	}
+	if o.HostID != "" {
+		opts = append(opts, "hostid="+o.HostID)
+	}
+	if o.CtrlLossTimeout != 0 {
+		opts = append(opts, "ctrl_loss_tmo="+strconv.Itoa(o.CtrlLossTimeout))
+	}
+	return strings.Join(opts, ",")
+}
+
+// Connect creates a new controller for the subsystem and returns it.
+func (h *Host) Connect(o ConnectOptions) (Controller, error) {
+	if o.SubsystemNQN == "" || o.Address == "" {
+		return Controller{}, errors.New("connect needs a subsystem NQN and an address")
+	}
+	f, err := os.OpenFile(filepath.Join(h.DevRoot, "nvme-fabrics"), os.O_RDWR, 0)
+	if err != nil {
+		return Controller{}, err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(o.String()); err != nil {
+		return Controller{}, fmt.Errorf("connecting to %s at %s: %w", o.SubsystemNQN, o.Address, err)
+	}
+	// The kernel answers on the same file descriptor with the instance of
+	// the new controller, as "instance=0,cntlid=1".
+	buf := make([]byte, 256)
+	n, err := f.Read(buf)
+	if err != nil {
+		return Controller{}, fmt.Errorf("reading connect result: %w", err)
+	}
+	instance := -1
+	for _, field := range strings.Split(strings.TrimSpace(string(buf[:n])), ",") {
+		if v, ok := strings.CutPrefix(field, "instance="); ok {
+			instance, err = strconv.Atoi(v)
+			if err != nil {
+				return Controller{}, fmt.Errorf("bad connect result %q", buf[:n])
+			}
+		}
+	}
+	if instance < 0 {
+		return Controller{}, fmt.Errorf("bad connect result %q", buf[:n])
+	}
+	return h.Controller(fmt.Sprintf("nvme%d", instance))
+}
+
+// readAttr returns the trimmed contents of a sysfs attribute, or "" if it
+// can't be read.
+func readAttr(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// writeAttr writes a value to a sysfs attribute.
+func writeAttr(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package nvme
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTree creates files under root, by slash separated path, with the
+// given contents.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnectOptionsString(t *testing.T) {
+	tests := []struct {
+		name string
+		o    ConnectOptions
+		want string
+	}{
+		{
+			name: "defaults",
+			o:    ConnectOptions{Address: "192.168.0.107", SubsystemNQN: "nqn.2024-01.com.example:vol1"},
+			want: "nqn=nqn.2024-01.com.example:vol1,transport=tcp,traddr=192.168.0.107,trsvcid=4420",
+		},
+		{
+			name: "everything",
+			o: ConnectOptions{
+				Transport:       "rdma",
+				Address:         "fd00::1",
+				ServiceID:       "4421",
+				SubsystemNQN:    "nqn.2024-01.com.example:vol1",
+				HostNQN:         "nqn.2014-08.org.nvmexpress:uuid:1b4e28ba-2fa1-11d2-883f-0016d3cca427",
+				HostID:          "1b4e28ba-2fa1-11d2-883f-0016d3cca427",
+				CtrlLossTimeout: 600,
+			},
+			want: "nqn=nqn.2024-01.com.example:vol1,transport=rdma,traddr=fd00::1,trsvcid=4421," +
+				"hostnqn=nqn.2014-08.org.nvmexpress:uuid:1b4e28ba-2fa1-11d2-883f-0016d3cca427," +
+				"hostid=1b4e28ba-2fa1-11d2-883f-0016d3cca427,ctrl_loss_tmo=600",
+		},
+		{
+			name: "retry forever",
+			o:    ConnectOptions{Address: "10.0.0.1", SubsystemNQN: "nqn.x", CtrlLossTimeout: -1},
+			want: "nqn=nqn.x,transport=tcp,traddr=10.0.0.1,trsvcid=4420,ctrl_loss_tmo=-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.o.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"log/slog"
 	"os"
 
@@ -9,6 +11,21 @@ import (
 
 const version = "1.0"
 
+// backendConfig is the layout of the optional backend config file. Values
+// in it are only used where no flag or environment variable is set.
+type backendConfig struct {
+	Scheme   string `json:"scheme"`
+	Hostname string `json:"hostname"`
+	Port     string `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	CAFile   string `json:"caFile"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	Insecure bool   `json:"insecureSkipVerify"`
+}
+
 func main() {
 
 	slog.Info("CSI Driver is Starting")
@@ -29,16 +46,72 @@ func main() {
 		os.Exit(1)
 	}
 
-	slog.Info("startup", "NodeIP", nodeIP)
-	slog.Info("startup", "DriverName", driverName)
-	slog.Info("startup", "Endpoint", csiEndpoint)
-
 	driverOptions := service.DriverOptions{
 		NodeID:     nodeIP,
 		DriverName: driverName,
 		Endpoint:   csiEndpoint,
 		Version:    version,
 	}
+
+	// Backend settings come from flags, which default to the environment,
+	// falling back to the config file for anything still unset.
+	var configFile string
+	flag.StringVar(&configFile, "backend-config", os.Getenv("BACKEND_CONFIG"), "path to a JSON backend config file")
+	flag.StringVar(&driverOptions.BackendScheme, "backend-scheme", os.Getenv("BACKEND_SCHEME"), "backend scheme, http or https")
+	flag.StringVar(&driverOptions.BackendHostname, "backend-hostname", os.Getenv("BACKEND_HOSTNAME"), "backend hostname")
+	flag.StringVar(&driverOptions.BackendPort, "backend-port", os.Getenv("BACKEND_PORT"), "backend port")
+	flag.StringVar(&driverOptions.BackendUsername, "backend-username", os.Getenv("BACKEND_USERNAME"), "backend username")
+	flag.StringVar(&driverOptions.BackendPassword, "backend-password", os.Getenv("BACKEND_PASSWORD"), "backend password")
+	flag.StringVar(&driverOptions.BackendToken, "backend-token", os.Getenv("BACKEND_TOKEN"), "backend bearer API token")
+	flag.StringVar(&driverOptions.BackendTLS.CAFile, "backend-ca-file", os.Getenv("BACKEND_CA_FILE"), "PEM bundle of CAs trusted for the backend certificate")
+	flag.StringVar(&driverOptions.BackendTLS.CertFile, "backend-cert-file", os.Getenv("BACKEND_CERT_FILE"), "client certificate for mutual TLS with the backend")
+	flag.StringVar(&driverOptions.BackendTLS.KeyFile, "backend-key-file", os.Getenv("BACKEND_KEY_FILE"), "client key for mutual TLS with the backend")
+	flag.BoolVar(&driverOptions.BackendTLS.InsecureSkipVerify, "backend-insecure-skip-verify", os.Getenv("BACKEND_INSECURE_SKIP_VERIFY") == "true", "skip verification of the backend certificate, for labs only")
+	flag.StringVar(&driverOptions.HostNQNFile, "hostnqn-file", os.Getenv("HOSTNQN_FILE"), "file holding the node's NVMe host NQN, created if missing (default /etc/nvme/hostnqn)")
+	flag.Parse()
+
+	if configFile != "" {
+		if err := applyBackendConfig(configFile, &driverOptions); err != nil {
+			slog.Error("reading backend config", "file", configFile, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	slog.Info("startup", "NodeIP", nodeIP)
+	slog.Info("startup", "DriverName", driverName)
+	slog.Info("startup", "Endpoint", csiEndpoint)
+	slog.Info("startup", "Backend", driverOptions.BackendHostname, "BackendPort", driverOptions.BackendPort)
+
 	d := service.NewDriver(&driverOptions)
 	d.Run(false)
 }
+
+// applyBackendConfig reads the backend config file and fills in any backend
+// option that is still empty.
+func applyBackendConfig(path string, options *service.DriverOptions) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg backendConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return err
+	}
+	setIfEmpty(&options.BackendScheme, cfg.Scheme)
+	setIfEmpty(&options.BackendHostname, cfg.Hostname)
+	setIfEmpty(&options.BackendPort, cfg.Port)
+	setIfEmpty(&options.BackendUsername, cfg.Username)
+	setIfEmpty(&options.BackendPassword, cfg.Password)
+	setIfEmpty(&options.BackendToken, cfg.Token)
+	setIfEmpty(&options.BackendTLS.CAFile, cfg.CAFile)
+	setIfEmpty(&options.BackendTLS.CertFile, cfg.CertFile)
+	setIfEmpty(&options.BackendTLS.KeyFile, cfg.KeyFile)
+	options.BackendTLS.InsecureSkipVerify = options.BackendTLS.InsecureSkipVerify || cfg.Insecure
+	return nil
+}
+
+func setIfEmpty(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
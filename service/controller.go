@@ -2,14 +2,14 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
-	"math/rand"
 	"strconv"
 	"time"
 
-	"example.com/csiproject/backend/client"
+	backend "example.com/csiproject/backend/client"
 	"example.com/csiproject/backend/model"
 
 	//"infinibox-csi-driver/api"
@@ -17,8 +17,6 @@ import (
 	//"infinibox-csi-driver/common"
 	//"infinibox-csi-driver/storage"
 
-	"strings"
-
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
 	"log/slog"
@@ -26,6 +24,18 @@ import (
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// defaultVolumeSizeBytes is used when CreateVolume gets no CapacityRange.
+	defaultVolumeSizeBytes = 1 << 30
+	// volumeSizeAlignment is the granularity the backend allocates volumes in.
+	volumeSizeAlignment = 1 << 20
+	// backendTimeout bounds each call the controller makes to the backend.
+	backendTimeout = 30 * time.Second
+	// defaultBackendPort is the port the backend listens on by default.
+	defaultBackendPort = "10000"
 )
 
 // ControllerServer controller server setting
@@ -33,6 +43,50 @@ type ControllerServer struct {
 	Driver *Driver
 }
 
+// Keys in the CSI secrets map that override the driver's backend settings,
+// matching the keys of the csi-driver-creds secret.
+const (
+	secretScheme   = "scheme"
+	secretHostname = "hostname"
+	secretPort     = "port"
+	secretUsername = "username"
+	secretPassword = "password"
+	secretToken    = "token"
+)
+
+// backendClient returns a client for the storage backend configured in the
+// driver options, with any settings present in the request's secrets taking
+// precedence.
+func (s *ControllerServer) backendClient(secrets map[string]string) (backend.Client, error) {
+	c := s.Driver.backend
+	// Credentials belong to the backend they were issued for, so secrets
+	// naming a backend or credentials of their own replace all of the
+	// driver's rather than mixing with them.
+	if secrets[secretHostname] != "" || secrets[secretUsername] != "" || secrets[secretToken] != "" {
+		c.Username, c.Password, c.Token = "", "", ""
+	}
+	overrides := map[string]*string{
+		secretScheme:   &c.Scheme,
+		secretHostname: &c.Hostname,
+		secretPort:     &c.Port,
+		secretUsername: &c.Username,
+		secretPassword: &c.Password,
+		secretToken:    &c.Token,
+	}
+	for key, field := range overrides {
+		if v := secrets[key]; v != "" {
+			*field = v
+		}
+	}
+	if c.Hostname == "" {
+		return c, status.Error(codes.FailedPrecondition, "no backend hostname configured")
+	}
+	if c.Port == "" {
+		c.Port = defaultBackendPort
+	}
+	return c, nil
+}
+
 // CreateVolume method create the volume
 func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (createVolResp *csi.CreateVolumeResponse, err error) {
 
@@ -62,30 +116,75 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeCapabilities invalid: %v", error)
 	}
 
-	client := client.Client{
-		Hostname: "192.168.0.108",
-		Port:     "10000",
+	capacity, err := requestedCapacity(req.GetCapacityRange())
+	if err != nil {
+		return nil, err
 	}
 
-	timeout := 30 * time.Second
-	reqContext, _ := context.WithTimeout(ctx, timeout)
+	source, err := contentSource(req.GetVolumeContentSource())
+	if err != nil {
+		return nil, err
+	}
 
-	volumeID := rand.Int()
+	client, err := s.backendClient(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
 
-	volume := model.Volume{ID: strconv.Itoa(volumeID), Name: "leader", Hostport: "192.168.0.112", Size: "1G"}
-	newVolume, err := client.CreateVolume(reqContext, volume)
+	reqContext, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+
+	// The external-provisioner retries CreateVolume after a timeout, so a
+	// volume with this name may already exist from an earlier attempt.
+	existing, err := client.GetVolumeByName(reqContext, volName)
+	if err == nil {
+		return existingVolume(existing.Volume, req, source)
+	} else if !backend.IsNotFound(err) {
+		return nil, backendError(err, "looking up volume %s", volName)
+	}
+
+	sourceBytes, err := sourceSize(reqContext, client, source)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if capacity < sourceBytes {
+		// Without a capacity range the volume gets the source's size, but an
+		// explicit one must leave room for the source's contents.
+		if req.GetCapacityRange().GetRequiredBytes() != 0 || req.GetCapacityRange().GetLimitBytes() != 0 {
+			return nil, status.Errorf(codes.OutOfRange, "requested capacity %d is smaller than the source's size %d", capacity, sourceBytes)
+		}
+		capacity = sourceBytes
 	}
-	fmt.Println(newVolume)
 
-	scParameters := make(map[string]string) //TODO
+	volume := model.Volume{
+		ID:               idForName(volName),
+		Name:             volName,
+		Hostport:         reqParameters["hostport"],
+		Size:             strconv.FormatInt(capacity, 10),
+		SourceSnapshotID: source.snapshotID,
+		SourceVolumeID:   source.volumeID,
+		Parameters:       reqParameters,
+	}
+	newVolume, err := client.CreateVolume(reqContext, volume)
+	if backend.IsAlreadyExists(err) {
+		// A concurrent attempt with the same name got there first.
+		existing, lookupErr := client.GetVolumeByName(reqContext, volName)
+		if lookupErr == nil {
+			return existingVolume(existing.Volume, req, source)
+		} else if !backend.IsNotFound(lookupErr) {
+			return nil, backendError(lookupErr, "looking up volume %s", volName)
+		}
+	}
+	if err != nil {
+		return nil, backendError(err, "creating volume %s", volName)
+	}
+	slog.Debug("CreateVolume", "volume", newVolume.Volume)
 
 	createVolResp = &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      strconv.Itoa(volumeID),
-			CapacityBytes: 1073741824,
-			VolumeContext: scParameters,
+			VolumeId:      newVolume.Volume.ID,
+			CapacityBytes: newVolume.Volume.CapacityBytes,
+			VolumeContext: newVolume.Volume.Context,
 			ContentSource: req.GetVolumeContentSource(),
 		},
 	}
@@ -107,6 +206,24 @@ func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolu
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	client, err := s.backendClient(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	reqContext, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+
+	err = client.DeleteVolume(reqContext, volumeId)
+	if backend.IsNotFound(err) {
+		// Already gone, possibly deleted by an earlier attempt of this call.
+		slog.Info("DeleteVolume", "volume not found, treating as deleted - ID", volumeId)
+	} else if err != nil {
+		return nil, backendError(err, "deleting volume %s", volumeId)
+	}
+
+	deleteVolResp = &csi.DeleteVolumeResponse{}
+
 	slog.Info("DeleteVolume", "Finish - ID", volumeId)
 	return
 }
@@ -135,16 +252,59 @@ func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi
 		return
 	}
 
-	err = validateNodeID(req.GetNodeId())
+	node, err := parseNodeID(req.GetNodeId())
+	if err != nil {
+		return nil, err
+	}
+	if node.HostNQN == "" {
+		// Nodes registered by a node plugin that predates host NQNs can't
+		// be told apart on the target.
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s has not reported an NVMe host NQN, restart its node plugin", req.GetNodeId())
+	}
+
+	client, err := s.backendClient(req.GetSecrets())
 	if err != nil {
 		return nil, err
 	}
 
-	slog.Info("ControllerPublishVolume", "Finish - ID", req.GetVolumeId())
+	reqContext, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+
+	allowed, err := client.AllowHost(reqContext, req.GetVolumeId(), node.HostNQN)
+	if err != nil {
+		return nil, backendError(err, "allowing host %s on volume %s", node.HostNQN, req.GetVolumeId())
+	}
+
+	publishVolResp = &csi.ControllerPublishVolumeResponse{
+		PublishContext: publishContext(allowed.Volume),
+	}
+
+	slog.Info("ControllerPublishVolume", "Finish - ID", req.GetVolumeId(), "hostNQN", node.HostNQN)
 
 	return
 }
 
+// publishContext picks out of the volume context what a node needs to
+// connect to the volume's NVMe target.
+func publishContext(volume model.Volume) map[string]string {
+	publish := make(map[string]string)
+	for _, key := range []string{
+		model.ContextTransport,
+		model.ContextAddress,
+		model.ContextPort,
+		model.ContextSubsystemNQN,
+		model.ContextNamespaceUUID,
+	} {
+		if v := volume.Context[key]; v != "" {
+			publish[key] = v
+		}
+	}
+	if publish[model.ContextSubsystemNQN] == "" && volume.SubsystemNQN != "" {
+		publish[model.ContextSubsystemNQN] = volume.SubsystemNQN
+	}
+	return publish
+}
+
 // ControllerUnpublishVolume method
 func (s *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (unpublishVolResp *csi.ControllerUnpublishVolumeResponse, err error) {
 	slog.Info("ControllerUnpublishVolume", "Start - ID", req.GetVolumeId(), "nodeID", req.GetNodeId())
@@ -155,11 +315,175 @@ func (s *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *c
 		return
 	}
 
+	// An empty node ID means the volume is to be unpublished from every node.
+	var node nodeInfo
+	if req.GetNodeId() != "" {
+		node, err = parseNodeID(req.GetNodeId())
+		if err != nil {
+			return nil, err
+		}
+		if node.HostNQN == "" {
+			// Such a node could never have been granted access.
+			slog.Info("ControllerUnPublishVolume", "Finish - node has no host NQN - ID", req.GetVolumeId())
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+	}
+
+	client, err := s.backendClient(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	reqContext, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+
+	if node.HostNQN == "" {
+		err = client.RevokeAllHosts(reqContext, req.GetVolumeId())
+	} else {
+		err = client.RevokeHost(reqContext, req.GetVolumeId(), node.HostNQN)
+	}
+	if backend.IsNotFound(err) {
+		// A deleted volume has no grants left to revoke.
+		slog.Info("ControllerUnPublishVolume", "volume not found, treating as unpublished - ID", req.GetVolumeId())
+	} else if err != nil {
+		return nil, backendError(err, "revoking host %q on volume %s", node.HostNQN, req.GetVolumeId())
+	}
+
+	unpublishVolResp = &csi.ControllerUnpublishVolumeResponse{}
+
 	slog.Info("ControllerUnPublishVolume", "Finish - ID", req.GetVolumeId())
 
 	return
 }
 
+// requestedCapacity picks the number of bytes to allocate for a new volume
+// from the CSI capacity range. The required bytes win when set, otherwise the
+// limit is used, and a volume with no range at all gets the default size.
+// The result is rounded up to volumeSizeAlignment without exceeding the limit.
+func requestedCapacity(capRange *csi.CapacityRange) (int64, error) {
+	required := capRange.GetRequiredBytes()
+	limit := capRange.GetLimitBytes()
+	if required < 0 || limit < 0 {
+		return 0, status.Error(codes.InvalidArgument, "CapacityRange bytes cannot be negative")
+	}
+	if limit > 0 && required > limit {
+		return 0, status.Errorf(codes.OutOfRange, "required bytes %d exceed limit bytes %d", required, limit)
+	}
+
+	capacity := required
+	if capacity == 0 {
+		capacity = limit
+	}
+	if capacity == 0 {
+		capacity = defaultVolumeSizeBytes
+	}
+	capacity = (capacity + volumeSizeAlignment - 1) / volumeSizeAlignment * volumeSizeAlignment
+	if limit > 0 && capacity > limit {
+		return 0, status.Errorf(codes.OutOfRange, "limit bytes %d too small for an allocation unit of %d bytes", limit, volumeSizeAlignment)
+	}
+	return capacity, nil
+}
+
+// existingVolume answers a CreateVolume request for a volume that already
+// exists with that name, which is only a success if the volume matches the
+// request and has been provisioned.
+func existingVolume(volume model.Volume, req *csi.CreateVolumeRequest, source volumeSource) (*csi.CreateVolumeResponse, error) {
+	if volume.Provisioning {
+		// Another attempt is still creating it, and it must not be handed
+		// out before its space exists.
+		return nil, status.Errorf(codes.Aborted, "volume %s is still being provisioned", req.GetName())
+	}
+	if !capacityCompatible(volume.CapacityBytes, req.GetCapacityRange()) {
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with incompatible capacity %d", req.GetName(), volume.CapacityBytes)
+	}
+	if volume.SourceSnapshotID != source.snapshotID || volume.SourceVolumeID != source.volumeID {
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with a different content source", req.GetName())
+	}
+	slog.Info("CreateVolume Finish - already exists", "Name", req.GetName(), "ID", volume.ID)
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volume.ID,
+			CapacityBytes: volume.CapacityBytes,
+			VolumeContext: volume.Context,
+			ContentSource: req.GetVolumeContentSource(),
+		},
+	}, nil
+}
+
+// idForName derives the backend ID of a volume or snapshot from its CSI name,
+// so every retry of a CreateVolume or CreateSnapshot asks the backend for the
+// same one.
+func idForName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:16])
+}
+
+// volumeSource is the snapshot or volume a new volume is populated from.
+// Both IDs are empty for an empty volume.
+type volumeSource struct {
+	snapshotID string
+	volumeID   string
+}
+
+// contentSource validates the content source of a CreateVolume request.
+func contentSource(src *csi.VolumeContentSource) (volumeSource, error) {
+	var source volumeSource
+	switch {
+	case src == nil:
+	case src.GetSnapshot() != nil:
+		source.snapshotID = src.GetSnapshot().GetSnapshotId()
+		if source.snapshotID == "" {
+			return source, status.Error(codes.InvalidArgument, "VolumeContentSource snapshot ID was empty")
+		}
+	case src.GetVolume() != nil:
+		source.volumeID = src.GetVolume().GetVolumeId()
+		if source.volumeID == "" {
+			return source, status.Error(codes.InvalidArgument, "VolumeContentSource volume ID was empty")
+		}
+	default:
+		return source, status.Error(codes.InvalidArgument, "unsupported VolumeContentSource type")
+	}
+	return source, nil
+}
+
+// sourceSize returns the size of the snapshot or volume a new volume is
+// populated from, which the volume can't be smaller than, or a NotFound
+// error if the source doesn't exist.
+func sourceSize(ctx context.Context, client backend.Client, source volumeSource) (int64, error) {
+	switch {
+	case source.snapshotID != "":
+		snapshot, err := client.GetSnapshot(ctx, source.snapshotID)
+		if backend.IsNotFound(err) {
+			return 0, status.Errorf(codes.NotFound, "source snapshot %s not found", source.snapshotID)
+		} else if err != nil {
+			return 0, backendError(err, "looking up source snapshot %s", source.snapshotID)
+		}
+		return snapshot.Snapshot.SizeBytes, nil
+	case source.volumeID != "":
+		volume, err := client.GetVolume(ctx, source.volumeID)
+		if backend.IsNotFound(err) {
+			return 0, status.Errorf(codes.NotFound, "source volume %s not found", source.volumeID)
+		} else if err != nil {
+			return 0, backendError(err, "looking up source volume %s", source.volumeID)
+		}
+		return volume.Volume.CapacityBytes, nil
+	default:
+		return 0, nil
+	}
+}
+
+// capacityCompatible reports whether an existing volume of the given
+// capacity satisfies the requested CapacityRange.
+func capacityCompatible(capacity int64, capRange *csi.CapacityRange) bool {
+	if capacity < capRange.GetRequiredBytes() {
+		return false
+	}
+	if limit := capRange.GetLimitBytes(); limit > 0 && capacity > limit {
+		return false
+	}
+	return true
+}
+
 func validateCapabilities(capabilities []*csi.VolumeCapability) error {
 	isBlock := false
 	isFile := false
@@ -236,15 +560,93 @@ func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumes
 func (s *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
 	slog.Info("ControllerListSnapshots Started")
 
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "max_entries %d is negative", req.GetMaxEntries())
+	}
+
+	client, err := s.backendClient(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	reqContext, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+
+	// A filter naming a snapshot or volume that doesn't exist matches
+	// nothing, which is not an error.
+	var snapshots []model.Snapshot
+	switch {
+	case req.GetSnapshotId() != "":
+		found, err := client.GetSnapshot(reqContext, req.GetSnapshotId())
+		if err != nil && !backend.IsNotFound(err) {
+			return nil, backendError(err, "looking up snapshot %s", req.GetSnapshotId())
+		}
+		if err == nil && (req.GetSourceVolumeId() == "" || req.GetSourceVolumeId() == found.Snapshot.SourceVolumeID) {
+			snapshots = append(snapshots, found.Snapshot)
+		}
+	case req.GetSourceVolumeId() != "":
+		found, err := client.GetVolumeSnapshots(reqContext, req.GetSourceVolumeId())
+		if err != nil && !backend.IsNotFound(err) {
+			return nil, backendError(err, "listing snapshots of volume %s", req.GetSourceVolumeId())
+		}
+		if err == nil {
+			snapshots = found.Snapshots
+		}
+	default:
+		found, err := client.GetAllSnapshots(reqContext)
+		if err != nil {
+			return nil, backendError(err, "listing snapshots")
+		}
+		snapshots = found.Snapshots
+	}
+
+	start, end, nextToken, err := paginate(len(snapshots), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
 	res := &csi.ListSnapshotsResponse{
-		Entries: make([]*csi.ListSnapshotsResponse_Entry, 0),
+		Entries:   make([]*csi.ListSnapshotsResponse_Entry, 0, end-start),
+		NextToken: nextToken,
+	}
+	for _, snapshot := range snapshots[start:end] {
+		res.Entries = append(res.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnapshot(snapshot)})
 	}
 
-	slog.Info("ControllerListSnapshots Finished")
+	slog.Info("ControllerListSnapshots Finished", "entries", len(res.Entries), "nextToken", nextToken)
 
 	return res, nil
 }
 
+// paginate picks the page of a list of n entries that starts at the
+// starting token, which is the index of its first entry, and holds at most
+// maxEntries, or every remaining entry when maxEntries is 0. It returns the
+// page's bounds and the token of the next page, empty on the last page.
+func paginate(n int, startingToken string, maxEntries int32) (start, end int, nextToken string, err error) {
+	if startingToken != "" {
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > n {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting_token %q", startingToken)
+		}
+	}
+	end = n
+	if maxEntries > 0 && start+int(maxEntries) < n {
+		end = start + int(maxEntries)
+		nextToken = strconv.Itoa(end)
+	}
+	return start, end, nextToken, nil
+}
+
+// csiSnapshot converts a backend snapshot to its CSI form.
+func csiSnapshot(snapshot model.Snapshot) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     snapshot.ID,
+		SourceVolumeId: snapshot.SourceVolumeID,
+		SizeBytes:      snapshot.SizeBytes,
+		CreationTime:   timestamppb.New(snapshot.CreationTime),
+		ReadyToUse:     snapshot.ReadyToUse,
+	}
+}
+
 func (s *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
@@ -307,25 +709,122 @@ func (s *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *c
 
 func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (createSnapshotResp *csi.CreateSnapshotResponse, err error) {
 
-	slog.Info("ControllerCreateSnapshot", "Started - ID", req.GetSourceVolumeId())
+	slog.Info("ControllerCreateSnapshot", "Started - ID", req.GetSourceVolumeId(), "name", req.GetName())
 
-	slog.Info("ControllerCreateSnapshot", "Finished - ID", req.GetSourceVolumeId())
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot request name was empty")
+	}
+	if req.GetSourceVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot request sourceVolumeId was empty")
+	}
 
-	return nil, nil
+	client, err := s.backendClient(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	reqContext, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+
+	// The external-snapshotter retries CreateSnapshot until it succeeds, so
+	// a snapshot with this name may already exist from an earlier attempt,
+	// or be taken concurrently by another one.
+	created, err := client.GetSnapshotByName(reqContext, req.GetName())
+	if backend.IsNotFound(err) {
+		snapshot := model.Snapshot{
+			ID:   idForName(req.GetName()),
+			Name: req.GetName(),
+		}
+		created, err = client.CreateSnapshot(reqContext, req.GetSourceVolumeId(), snapshot)
+		if backend.IsAlreadyExists(err) {
+			created, err = client.GetSnapshotByName(reqContext, req.GetName())
+			if backend.IsNotFound(err) {
+				// The snapshot's ID is taken by a concurrent attempt that
+				// hasn't recorded it yet.
+				return nil, status.Errorf(codes.Aborted, "snapshot %s is still being taken", req.GetName())
+			}
+		}
+	}
+	if err != nil {
+		return nil, backendError(err, "creating snapshot %s of volume %s", req.GetName(), req.GetSourceVolumeId())
+	}
+	if created.Snapshot.SourceVolumeID != req.GetSourceVolumeId() {
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists of volume %s", req.GetName(), created.Snapshot.SourceVolumeID)
+	}
+
+	createSnapshotResp = &csi.CreateSnapshotResponse{
+		Snapshot: csiSnapshot(created.Snapshot),
+	}
+
+	slog.Info("ControllerCreateSnapshot", "Finished - ID", req.GetSourceVolumeId(), "snapshotID", created.Snapshot.ID)
+
+	return
 }
 
 func (s *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (deleteSnapshotResp *csi.DeleteSnapshotResponse, err error) {
 
 	slog.Info("ControllerDeleteSnapshot", "Start - ID", req.GetSnapshotId())
 
-	return nil, nil
+	if req.GetSnapshotId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot request snapshotId was empty")
+	}
+
+	client, err := s.backendClient(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	reqContext, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+
+	if err := client.DeleteSnapshot(reqContext, req.GetSnapshotId()); backend.IsNotFound(err) {
+		slog.Info("ControllerDeleteSnapshot", "snapshot not found, treating as deleted - ID", req.GetSnapshotId())
+	} else if err != nil {
+		return nil, backendError(err, "deleting snapshot %s", req.GetSnapshotId())
+	}
+
+	deleteSnapshotResp = &csi.DeleteSnapshotResponse{}
+
+	slog.Info("ControllerDeleteSnapshot", "Finish - ID", req.GetSnapshotId())
+
+	return
 }
 
 func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (expandVolResp *csi.ControllerExpandVolumeResponse, err error) {
 
 	slog.Info("ControllerExpandVolume", "Started - ID", req.GetVolumeId())
 
-	slog.Info("ControllerExpandVolume", "Ended - ID", req.GetVolumeId())
+	if err := validateExpandVolumeRequest(req); err != nil {
+		return nil, err
+	}
+	capacity, err := requestedCapacity(req.GetCapacityRange())
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s.backendClient(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	reqContext, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+
+	// The backend succeeds without doing anything for a volume that is
+	// already large enough, as it is when the resizer retries.
+	expanded, err := client.ExpandVolume(reqContext, req.GetVolumeId(), capacity)
+	if err != nil {
+		return nil, backendError(err, "expanding volume %s to %d bytes", req.GetVolumeId(), capacity)
+	}
+
+	// Hosts have to pick up the namespace's new size even for raw block
+	// volumes, and filesystems can only be grown where they are mounted.
+	expandVolResp = &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         expanded.Volume.CapacityBytes,
+		NodeExpansionRequired: true,
+	}
+
+	slog.Info("ControllerExpandVolume", "Ended - ID", req.GetVolumeId(), "capacity", expanded.Volume.CapacityBytes)
 
 	return
 }
@@ -343,17 +842,6 @@ func (s *ControllerServer) ControllerGetVolume(_ context.Context, _ *csi.Control
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
-func validateNodeID(nodeID string) error {
-	if nodeID == "" {
-		return status.Error(codes.InvalidArgument, "node ID empty")
-	}
-	nodeSplit := strings.Split(nodeID, "$$")
-	if len(nodeSplit) != 2 {
-		return status.Error(codes.NotFound, "node Id does not follow '<fqdn>$$<id>' pattern")
-	}
-	return nil
-}
-
 // Controller expand volume request validation
 func validateExpandVolumeRequest(req *csi.ControllerExpandVolumeRequest) error {
 	if req.GetVolumeId() == "" {
@@ -363,5 +851,10 @@ func validateExpandVolumeRequest(req *csi.ControllerExpandVolumeRequest) error {
 	if capRange == nil {
 		return status.Error(codes.InvalidArgument, "CapacityRange cannot be empty")
 	}
+	// Unlike CreateVolume there is no default size to fall back to, an
+	// expansion has to say how large the volume should be.
+	if capRange.GetRequiredBytes() == 0 && capRange.GetLimitBytes() == 0 {
+		return status.Error(codes.InvalidArgument, "CapacityRange must set required_bytes or limit_bytes")
+	}
 	return nil
 }
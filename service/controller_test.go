@@ -0,0 +1,247 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	backend "example.com/csiproject/backend/client"
+	"example.com/csiproject/backend/model"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBackendClient(t *testing.T) {
+	driver := backend.Client{Scheme: "https", Hostname: "backend.default", Token: "driver-token"}
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		want    backend.Client
+	}{
+		{
+			name: "no secrets",
+			want: backend.Client{Scheme: "https", Hostname: "backend.default", Port: defaultBackendPort, Token: "driver-token"},
+		},
+		{
+			name:    "other backend with basic credentials",
+			secrets: map[string]string{"hostname": "backend.other", "port": "9000", "username": "csi", "password": "secret"},
+			want:    backend.Client{Scheme: "https", Hostname: "backend.other", Port: "9000", Username: "csi", Password: "secret"},
+		},
+		{
+			name:    "other backend without credentials",
+			secrets: map[string]string{"hostname": "backend.other"},
+			want:    backend.Client{Scheme: "https", Hostname: "backend.other", Port: defaultBackendPort},
+		},
+		{
+			name:    "basic credentials for the default backend",
+			secrets: map[string]string{"username": "csi", "password": "secret"},
+			want:    backend.Client{Scheme: "https", Hostname: "backend.default", Port: defaultBackendPort, Username: "csi", Password: "secret"},
+		},
+		{
+			name:    "token for the default backend",
+			secrets: map[string]string{"token": "class-token"},
+			want:    backend.Client{Scheme: "https", Hostname: "backend.default", Port: defaultBackendPort, Token: "class-token"},
+		},
+		{
+			name:    "scheme only",
+			secrets: map[string]string{"scheme": "http"},
+			want:    backend.Client{Scheme: "http", Hostname: "backend.default", Port: defaultBackendPort, Token: "driver-token"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &ControllerServer{Driver: &Driver{backend: driver}}
+			got, err := s.backendClient(test.secrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("backendClient() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	s := &ControllerServer{Driver: &Driver{}}
+	if _, err := s.backendClient(nil); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("backendClient() without a hostname error = %v, want FailedPrecondition", err)
+	}
+}
+
+func TestIDForName(t *testing.T) {
+	id := idForName("snapshot-1b4e28ba")
+	if again := idForName("snapshot-1b4e28ba"); again != id {
+		t.Errorf("idForName() = %q then %q, want the same ID for every attempt", id, again)
+	}
+	if other := idForName("snapshot-2c4e28ba"); other == id {
+		t.Errorf("idForName() = %q for two names", id)
+	}
+	// IDs become file and LV names, so they stay short and plain.
+	if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+		t.Errorf("idForName() = %q, want 32 hex digits", id)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		name          string
+		n             int
+		startingToken string
+		maxEntries    int32
+		start, end    int
+		nextToken     string
+		code          codes.Code
+	}{
+		{name: "everything", n: 5, start: 0, end: 5},
+		{name: "first page", n: 5, maxEntries: 2, start: 0, end: 2, nextToken: "2"},
+		{name: "middle page", n: 5, startingToken: "2", maxEntries: 2, start: 2, end: 4, nextToken: "4"},
+		{name: "last page", n: 5, startingToken: "4", maxEntries: 2, start: 4, end: 5},
+		{name: "page ending on the last entry", n: 4, startingToken: "2", maxEntries: 2, start: 2, end: 4},
+		{name: "rest from a token", n: 5, startingToken: "3", start: 3, end: 5},
+		{name: "token at the end", n: 5, startingToken: "5", start: 5, end: 5},
+		{name: "empty list", n: 0, maxEntries: 10, start: 0, end: 0},
+		{name: "token past the end", n: 5, startingToken: "6", code: codes.Aborted},
+		{name: "negative token", n: 5, startingToken: "-1", code: codes.Aborted},
+		{name: "malformed token", n: 5, startingToken: "page-2", code: codes.Aborted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end, nextToken, err := paginate(test.n, test.startingToken, test.maxEntries)
+			if status.Code(err) != test.code {
+				t.Fatalf("paginate() error = %v, want code %v", err, test.code)
+			}
+			if err != nil {
+				return
+			}
+			if start != test.start || end != test.end || nextToken != test.nextToken {
+				t.Errorf("paginate() = %d, %d, %q, want %d, %d, %q", start, end, nextToken, test.start, test.end, test.nextToken)
+			}
+		})
+	}
+}
+
+// snapshotBackend serves n snapshots on GET /snapshots and returns a
+// controller using it.
+func snapshotBackend(t *testing.T, n int) *ControllerServer {
+	t.Helper()
+	snapshots := make([]model.Snapshot, n)
+	for i := range snapshots {
+		snapshots[i] = model.Snapshot{ID: strconv.Itoa(i), SourceVolumeID: "vol1", ReadyToUse: true}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/snapshots" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(snapshots)
+	}))
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ControllerServer{Driver: &Driver{backend: backend.Client{Hostname: host, Port: port}}}
+}
+
+func TestListSnapshotsPages(t *testing.T) {
+	s := snapshotBackend(t, 5)
+	var ids []string
+	var pages int
+	req := &csi.ListSnapshotsRequest{MaxEntries: 2}
+	for {
+		res, err := s.ListSnapshots(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, entry := range res.GetEntries() {
+			ids = append(ids, entry.GetSnapshot().GetSnapshotId())
+		}
+		if res.GetNextToken() == "" {
+			break
+		}
+		req.StartingToken = res.GetNextToken()
+	}
+	if pages != 3 || strings.Join(ids, ",") != "0,1,2,3,4" {
+		t.Errorf("got %v in %d pages, want every snapshot in 3", ids, pages)
+	}
+
+	_, err := s.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{StartingToken: "9"})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("ListSnapshots() with a stale token error = %v, want Aborted", err)
+	}
+	_, err = s.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: -1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListSnapshots() with negative max_entries error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestRequestedCapacity(t *testing.T) {
+	const mib = 1 << 20
+	tests := []struct {
+		name     string
+		capRange *csi.CapacityRange
+		want     int64
+		code     codes.Code
+	}{
+		{name: "no range", want: defaultVolumeSizeBytes},
+		{name: "empty range", capRange: &csi.CapacityRange{}, want: defaultVolumeSizeBytes},
+		{name: "aligned required", capRange: &csi.CapacityRange{RequiredBytes: 3 * mib}, want: 3 * mib},
+		{name: "required rounded up", capRange: &csi.CapacityRange{RequiredBytes: 3*mib + 1}, want: 4 * mib},
+		{name: "tiny required", capRange: &csi.CapacityRange{RequiredBytes: 1}, want: mib},
+		{name: "limit only", capRange: &csi.CapacityRange{LimitBytes: 5 * mib}, want: 5 * mib},
+		{name: "required equals limit", capRange: &csi.CapacityRange{RequiredBytes: 3 * mib, LimitBytes: 3 * mib}, want: 3 * mib},
+		{name: "rounded up within limit", capRange: &csi.CapacityRange{RequiredBytes: 3*mib + 1, LimitBytes: 4 * mib}, want: 4 * mib},
+		{name: "rounded up past limit", capRange: &csi.CapacityRange{RequiredBytes: 3*mib + 1, LimitBytes: 4*mib - 1}, code: codes.OutOfRange},
+		{name: "limit below alignment", capRange: &csi.CapacityRange{RequiredBytes: 1, LimitBytes: 1000}, code: codes.OutOfRange},
+		{name: "required above limit", capRange: &csi.CapacityRange{RequiredBytes: 5 * mib, LimitBytes: 4 * mib}, code: codes.OutOfRange},
+		{name: "negative required", capRange: &csi.CapacityRange{RequiredBytes: -1}, code: codes.InvalidArgument},
+		{name: "negative limit", capRange: &csi.CapacityRange{LimitBytes: -1}, code: codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := requestedCapacity(test.capRange)
+			if status.Code(err) != test.code {
+				t.Fatalf("requestedCapacity() error = %v, want code %v", err, test.code)
+			}
+			if err == nil && got != test.want {
+				t.Errorf("requestedCapacity() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCapacityCompatible(t *testing.T) {
+	const gib = 1 << 30
+	tests := []struct {
+		name     string
+		capacity int64
+		capRange *csi.CapacityRange
+		want     bool
+	}{
+		{name: "no range", capacity: gib, want: true},
+		{name: "exactly required", capacity: gib, capRange: &csi.CapacityRange{RequiredBytes: gib}, want: true},
+		{name: "more than required", capacity: 2 * gib, capRange: &csi.CapacityRange{RequiredBytes: gib}, want: true},
+		{name: "less than required", capacity: gib, capRange: &csi.CapacityRange{RequiredBytes: 2 * gib}},
+		{name: "exactly limit", capacity: gib, capRange: &csi.CapacityRange{LimitBytes: gib}, want: true},
+		{name: "over limit", capacity: 2 * gib, capRange: &csi.CapacityRange{LimitBytes: gib}},
+		{name: "within range", capacity: 2 * gib, capRange: &csi.CapacityRange{RequiredBytes: gib, LimitBytes: 3 * gib}, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := capacityCompatible(test.capacity, test.capRange); got != test.want {
+				t.Errorf("capacityCompatible(%d, %v) = %v, want %v", test.capacity, test.capRange, got, test.want)
+			}
+		})
+	}
+}
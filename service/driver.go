@@ -4,8 +4,11 @@ import (
 	"log"
 	"runtime"
 
+	"example.com/csiproject/backend/client"
+	"example.com/csiproject/internal/nvme"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
 )
 
 type DriverOptions struct {
@@ -15,6 +18,19 @@ type DriverOptions struct {
 	Version          string
 	MountPermissions uint64
 	WorkingMountDir  string
+	// HostNQNFile holds the node's NVMe host NQN, created on first use if
+	// missing. Defaults to /etc/nvme/hostnqn.
+	HostNQNFile string
+
+	// Storage backend the controller provisions volumes on. Any of these
+	// can be overridden per request by the CSI secrets, see backendClient.
+	BackendScheme   string
+	BackendHostname string
+	BackendPort     string
+	BackendUsername string
+	BackendPassword string
+	BackendToken    string
+	BackendTLS      client.TLSOptions
 }
 
 type Driver struct {
@@ -24,6 +40,8 @@ type Driver struct {
 	endpoint         string
 	mountPermissions uint64
 	workingMountDir  string
+	hostNQNFile      string
+	backend          client.Client
 
 	//ids *identityServer
 	ns    *NodeServer
@@ -42,6 +60,15 @@ func NewDriver(options *DriverOptions) *Driver {
 		endpoint:         options.Endpoint,
 		mountPermissions: options.MountPermissions,
 		workingMountDir:  options.WorkingMountDir,
+		hostNQNFile:      options.HostNQNFile,
+		backend: client.Client{
+			Scheme:   options.BackendScheme,
+			Hostname: options.BackendHostname,
+			Port:     options.BackendPort,
+			Username: options.BackendUsername,
+			Password: options.BackendPassword,
+			Token:    options.BackendToken,
+		},
 	}
 
 	n.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
@@ -77,6 +104,21 @@ func NewDriver(options *DriverOptions) *Driver {
 		//csi.NodeServiceCapability_RPC_VOLUME_CONDITION
 		//csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER
 	})
+	if !options.BackendTLS.IsZero() {
+		httpClient, err := client.NewHTTPClient(options.BackendTLS)
+		if err != nil {
+			log.Fatalf("backend TLS configuration: %v", err)
+		}
+		n.backend.HTTPClient = httpClient
+		if n.backend.Scheme == "" {
+			n.backend.Scheme = "https"
+		}
+	}
+
+	if n.hostNQNFile == "" {
+		n.hostNQNFile = nvme.DefaultHostNQNFile
+	}
+
 	//n.volumeLocks = helper.NewVolumeLocks()
 	return n
 }
@@ -85,6 +127,8 @@ func NewNodeServer(n *Driver, mounter mount.Interface) *NodeServer {
 	return &NodeServer{
 		Driver:  n,
 		mounter: mounter,
+		exec:    utilexec.New(),
+		nvme:    nvme.NewHost(),
 	}
 }
 
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	backend "example.com/csiproject/backend/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// backendError translates an error returned by the backend client into a
+// gRPC status error, prefixing the message with the formatted description
+// of what the controller was doing.
+func backendError(err error, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	return status.Errorf(backendErrorCode(err), "%s: %v", msg, err)
+}
+
+// backendErrorCode picks the gRPC code for an error returned by the backend
+// client.
+func backendErrorCode(err error) codes.Code {
+	var netErr net.Error
+	switch {
+	case backend.IsAlreadyExists(err):
+		return codes.AlreadyExists
+	case backend.IsNotFound(err):
+		return codes.NotFound
+	case backend.IsValidation(err):
+		return codes.InvalidArgument
+	case backend.IsUnauthorized(err):
+		return codes.Unauthenticated
+	case backend.IsDatabase(err):
+		return codes.Internal
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return codes.DeadlineExceeded
+	case errors.As(err, &netErr):
+		// The backend could not be reached at all, which is worth retrying.
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
@@ -0,0 +1,46 @@
+package service
+
+import "sync"
+
+// keyMutex hands out a mutex per key, so operations on the same key are
+// serialized while operations on different keys run in parallel.
+type keyMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// Lock locks the mutex for key.
+func (m *keyMutex) Lock(key string) {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyLock)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyLock{}
+		m.locks[key] = l
+	}
+	l.waiters++
+	m.mu.Unlock()
+
+	l.Lock()
+}
+
+// Unlock unlocks the mutex for key, forgetting it once nobody else holds
+// or waits for it.
+func (m *keyMutex) Unlock(key string) {
+	m.mu.Lock()
+	l := m.locks[key]
+	l.waiters--
+	if l.waiters == 0 {
+		delete(m.locks, key)
+	}
+	m.mu.Unlock()
+
+	l.Unlock()
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/mount-utils"
+)
+
+// mountInfoFor returns the topmost mount at path, or nil if nothing is
+// mounted there.
+func mountInfoFor(path string) (*mount.MountInfo, error) {
+	mounts, err := mount.ParseMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	path = filepath.Clean(path)
+	var found *mount.MountInfo
+	for i := range mounts {
+		// Later entries are mounted over earlier ones at the same path.
+		if mounts[i].MountPoint == path {
+			found = &mounts[i]
+		}
+	}
+	return found, nil
+}
+
+// sameSource reports whether two mounts expose the same directory of the
+// same filesystem, as a bind mount and its source do.
+func sameSource(a, b *mount.MountInfo) bool {
+	return a.Major == b.Major && a.Minor == b.Minor && a.Root == b.Root
+}
+
+// isReadOnly reports whether the mount is read only.
+func isReadOnly(m *mount.MountInfo) bool {
+	for _, opt := range m.MountOptions {
+		if opt == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// blockStagingFile is the file inside the staging directory that a raw
+// block volume's device node is bind mounted onto.
+func blockStagingFile(stagingPath, volumeID string) string {
+	return filepath.Join(stagingPath, volumeID)
+}
+
+// subsystemFile is the file next to the staging directory recording the
+// subsystem a volume was staged from. It outlives the mount, so an unstage
+// that fails after unmounting still knows what to disconnect when retried.
+func subsystemFile(stagingPath string) string {
+	return filepath.Clean(stagingPath) + ".subsystem"
+}
+
+// saveSubsystem records the subsystem a volume is staged from.
+func saveSubsystem(stagingPath, subsystemNQN string) error {
+	return os.WriteFile(subsystemFile(stagingPath), []byte(subsystemNQN+"\n"), 0640)
+}
+
+// savedSubsystem returns the subsystem recorded for the staging path, or ""
+// if there is none.
+func savedSubsystem(stagingPath string) (string, error) {
+	b, err := os.ReadFile(subsystemFile(stagingPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(b)), err
+}
+
+// stagedDevice returns the block device staged at stagingPath and the mount
+// point holding it: the staging directory for a filesystem volume, or the
+// block staging file for a raw block volume. Both are "" if nothing is
+// staged.
+func stagedDevice(stagingPath, volumeID string) (device, mountPoint string, err error) {
+	for _, p := range []string{stagingPath, blockStagingFile(stagingPath, volumeID)} {
+		m, err := mountInfoFor(p)
+		if err != nil {
+			return "", "", err
+		}
+		if m != nil {
+			return deviceOfMount(m), p, nil
+		}
+	}
+	return "", "", nil
+}
+
+// volumeDevice returns the block device mounted at path, as a filesystem or
+// as a bind mounted device node, and whether it is the latter. device is ""
+// if nothing is mounted there.
+func volumeDevice(path string) (device string, isBlock bool, err error) {
+	m, err := mountInfoFor(path)
+	if err != nil || m == nil {
+		return "", false, err
+	}
+	return deviceOfMount(m), m.FsType == "devtmpfs", nil
+}
+
+// deviceOfMount returns the block device behind a mount. A bind mounted
+// device node shows up as a mount of devtmpfs rooted at the node's path.
+func deviceOfMount(m *mount.MountInfo) string {
+	if m.FsType == "devtmpfs" {
+		return filepath.Join("/dev", m.Root)
+	}
+	return m.Source
+}
+
+// makeFile creates an empty file at path, and its parent directories, to
+// bind mount a device node onto.
+func makeFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
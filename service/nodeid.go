@@ -0,0 +1,50 @@
+package service
+
+import (
+	"strings"
+
+	"example.com/csiproject/internal/nvme"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// nodeIDSeparator joins the parts of a node ID.
+const nodeIDSeparator = "$$"
+
+// nodeInfo is what the node plugin reports about itself in its node ID,
+// "<fqdn>$$<id>$$<host NQN>". Node IDs registered before the host NQN was
+// added are "<fqdn>$$<id>" and parse with an empty HostNQN.
+type nodeInfo struct {
+	FQDN    string
+	ID      string
+	HostNQN string
+}
+
+func (n nodeInfo) String() string {
+	parts := []string{n.FQDN, n.ID}
+	if n.HostNQN != "" {
+		parts = append(parts, n.HostNQN)
+	}
+	return strings.Join(parts, nodeIDSeparator)
+}
+
+// parseNodeID splits a node ID built by NodeGetInfo back into its parts.
+func parseNodeID(nodeID string) (nodeInfo, error) {
+	if nodeID == "" {
+		return nodeInfo{}, status.Error(codes.InvalidArgument, "node ID empty")
+	}
+	// The host NQN comes last so it can't be cut short by a separator
+	// inside it.
+	parts := strings.SplitN(nodeID, nodeIDSeparator, 3)
+	if len(parts) < 2 {
+		return nodeInfo{}, status.Error(codes.NotFound, "node Id does not follow '<fqdn>$$<id>[$$<hostnqn>]' pattern")
+	}
+	info := nodeInfo{FQDN: parts[0], ID: parts[1]}
+	if len(parts) == 3 {
+		if err := nvme.ValidateNQN(parts[2]); err != nil {
+			return nodeInfo{}, status.Errorf(codes.NotFound, "node Id has an invalid host NQN: %v", err)
+		}
+		info.HostNQN = parts[2]
+	}
+	return info, nil
+}
@@ -5,20 +5,56 @@ import (
 	"fmt"
 	"log"
 	"log/slog"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
+	"example.com/csiproject/internal/nvme"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// fsTypeKey is the StorageClass parameter that picks the filesystem.
+	fsTypeKey = "csi.storage.k8s.io/fstype"
+	// defaultFsType is created when neither the capability nor the volume
+	// context asks for a filesystem.
+	defaultFsType = "ext4"
 )
 
 // NodeServer driver
 type NodeServer struct {
 	Driver  *Driver
 	mounter mount.Interface
+	exec    utilexec.Interface
+	nvme    *nvme.Host
+
+	// subsystemLocks serializes staging and unstaging of volumes that share
+	// an NVMe subsystem, so a connection isn't torn down while another
+	// volume is being staged on it.
+	subsystemLocks keyMutex
+
+	hostNQNOnce sync.Once
+	hostNQNVal  string
+	hostNQNErr  error
+}
+
+// hostNQN returns the node's NVMe host NQN, loading or creating the host
+// NQN file the first time it's needed. Only the node plugin calls this, so
+// controller pods never touch /etc/nvme.
+func (s *NodeServer) hostNQN() (string, error) {
+	s.hostNQNOnce.Do(func() {
+		s.hostNQNVal, s.hostNQNErr = nvme.LoadOrCreateHostNQN(s.Driver.hostNQNFile)
+		if s.hostNQNErr == nil {
+			slog.Info("hostNQN", "file", s.Driver.hostNQNFile, "NQN", s.hostNQNVal)
+		}
+	})
+	return s.hostNQNVal, s.hostNQNErr
 }
 
 func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
@@ -31,16 +67,76 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 	}
 
 	if req.GetStagingTargetPath() == "" {
-		err := fmt.Errorf("NodeUnstageVolume error stagingTargetPath parameter was empty")
+		err := fmt.Errorf("NodePublishVolume error stagingTargetPath parameter was empty")
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if req.GetTargetPath() == "" {
+		err := fmt.Errorf("NodePublishVolume error targetPath parameter was empty")
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	if req.VolumeCapability == nil {
-		err := fmt.Errorf("NodeUnstageVolume error volumeCapability parameter was nil")
+		err := fmt.Errorf("NodePublishVolume error volumeCapability parameter was nil")
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	return nil, nil
+	stagingPath := req.GetStagingTargetPath()
+	targetPath := req.GetTargetPath()
+	isBlock := req.GetVolumeCapability().GetBlock() != nil
+
+	// A filesystem volume is published from its staging directory, a raw
+	// block volume from the device node staged inside it.
+	sourcePath := stagingPath
+	if isBlock {
+		sourcePath = blockStagingFile(stagingPath, req.GetVolumeId())
+	}
+	source, err := mountInfoFor(sourcePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodePublishVolume error reading mounts: %v", err)
+	}
+	if source == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "NodePublishVolume error volume is not staged at %s", stagingPath)
+	}
+	if isBlock {
+		sourcePath = deviceOfMount(source)
+	}
+
+	existing, err := mountInfoFor(targetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodePublishVolume error reading mounts: %v", err)
+	}
+	if existing != nil {
+		if !sameSource(existing, source) {
+			return nil, status.Errorf(codes.AlreadyExists, "NodePublishVolume error %s already has %s mounted", targetPath, existing.Source)
+		}
+		if isReadOnly(existing) != req.GetReadonly() {
+			return nil, status.Errorf(codes.AlreadyExists, "NodePublishVolume error %s is already mounted with readonly=%t", targetPath, isReadOnly(existing))
+		}
+		slog.Info("NodePublishVolume", "already published - ID", req.GetVolumeId(), "path", targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	if isBlock {
+		if err := makeFile(targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "NodePublishVolume error creating %s: %v", targetPath, err)
+		}
+	} else {
+		if err := os.MkdirAll(targetPath, 0750); err != nil {
+			return nil, status.Errorf(codes.Internal, "NodePublishVolume error creating %s: %v", targetPath, err)
+		}
+		options = append(options, req.GetVolumeCapability().GetMount().GetMountFlags()...)
+	}
+	if err := s.mounter.Mount(sourcePath, targetPath, "", options); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodePublishVolume error bind mounting %s at %s: %v", sourcePath, targetPath, err)
+	}
+
+	slog.Info("NodePublishVolume", "Finished - ID", req.GetVolumeId(), "path", targetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
 }
 
 func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
@@ -56,8 +152,12 @@ func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	if err := mount.CleanupMountPoint(req.GetTargetPath(), s.mounter, true); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeUnpublishVolume error unmounting %s: %v", req.GetTargetPath(), err)
+	}
+
 	slog.Info("NodeUnpublishVolume", "Finished - ID", req.GetVolumeId())
-	return nil, nil
+	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (s *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
@@ -110,14 +210,18 @@ func (s *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReques
 			"topology.csi.example.com/zone": "true",
 		},
 	}
-	k8sNodeID := nodeFQDN + "$$" + s.Driver.nodeID
+	hostNQN, err := s.hostNQN()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeGetInfo error reading host NQN: %v", err)
+	}
+	k8sNodeID := nodeInfo{FQDN: nodeFQDN, ID: s.Driver.nodeID, HostNQN: hostNQN}
 	return &csi.NodeGetInfoResponse{
-		NodeId:             k8sNodeID,
+		NodeId:             k8sNodeID.String(),
 		AccessibleTopology: topo,
 	}, nil
 }
 
-func (s NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volumeId := req.GetVolumeId()
 	slog.Info("NodeStageVolume", "Started - ID", volumeId)
 
@@ -134,7 +238,71 @@ func (s NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolum
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	return nil, nil
+	target, err := nvmeTargetFromContext(req.GetPublishContext(), req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume error %v", err)
+	}
+
+	s.subsystemLocks.Lock(target.SubsystemNQN)
+	defer s.subsystemLocks.Unlock(target.SubsystemNQN)
+
+	stagingPath := req.GetStagingTargetPath()
+	staged, _, err := stagedDevice(stagingPath, volumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeStageVolume error checking %s: %v", stagingPath, err)
+	}
+	if staged != "" {
+		slog.Info("NodeStageVolume", "already staged - ID", volumeId, "path", stagingPath, "device", staged)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+	if err := os.MkdirAll(stagingPath, 0750); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeStageVolume error creating %s: %v", stagingPath, err)
+	}
+	if err := saveSubsystem(stagingPath, target.SubsystemNQN); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeStageVolume error recording the subsystem of %s: %v", stagingPath, err)
+	}
+
+	if err := s.connectNVMe(target); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeStageVolume error %v", err)
+	}
+	device, err := s.waitForNVMeDevice(ctx, target)
+	if err != nil {
+		return nil, status.Errorf(codes.DeadlineExceeded, "NodeStageVolume error %v", err)
+	}
+
+	if req.GetVolumeCapability().GetBlock() != nil {
+		// Raw block volumes get no filesystem. The device node is bind
+		// mounted into the staging directory so it can be found again at
+		// publish and unstage time.
+		file := blockStagingFile(stagingPath, volumeId)
+		if err := makeFile(file); err != nil {
+			return nil, status.Errorf(codes.Internal, "NodeStageVolume error creating %s: %v", file, err)
+		}
+		if err := s.mounter.Mount(device, file, "", []string{"bind"}); err != nil {
+			return nil, status.Errorf(codes.Internal, "NodeStageVolume error bind mounting %s at %s: %v", device, file, err)
+		}
+		slog.Info("NodeStageVolume", "Finished - ID", volumeId, "device", device, "block", true)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	mnt := req.GetVolumeCapability().GetMount()
+	fsType := mnt.GetFsType()
+	if fsType == "" {
+		fsType = req.GetVolumeContext()[fsTypeKey]
+	}
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+
+	// SafeFormatAndMount only creates a filesystem when the device is blank,
+	// so restaging a volume never wipes it.
+	formatter := mount.NewSafeFormatAndMount(s.mounter, s.exec)
+	if err := formatter.FormatAndMount(device, stagingPath, fsType, mnt.GetMountFlags()); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeStageVolume error mounting %s at %s: %v", device, stagingPath, err)
+	}
+
+	slog.Info("NodeStageVolume", "Finished - ID", volumeId, "device", device, "fsType", fsType)
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
 func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
@@ -151,7 +319,96 @@ func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	return nil, nil
+	stagingPath := req.GetStagingTargetPath()
+	device, mountPoint, err := stagedDevice(stagingPath, volumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeUnstageVolume error checking %s: %v", stagingPath, err)
+	}
+	if device == "" {
+		// Nothing mounted: the volume was never staged, or an earlier
+		// attempt got past the unmount and may still have to disconnect.
+		for _, p := range []string{blockStagingFile(stagingPath, volumeId), stagingPath} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return nil, status.Errorf(codes.Internal, "NodeUnstageVolume error removing %s: %v", p, err)
+			}
+		}
+		subsystemNQN, err := savedSubsystem(stagingPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "NodeUnstageVolume error reading the subsystem of %s: %v", stagingPath, err)
+		}
+		if subsystemNQN != "" {
+			s.subsystemLocks.Lock(subsystemNQN)
+			defer s.subsystemLocks.Unlock(subsystemNQN)
+			if err := s.disconnectStaged(stagingPath, subsystemNQN); err != nil {
+				return nil, status.Errorf(codes.Internal, "NodeUnstageVolume error %v", err)
+			}
+		}
+		slog.Info("NodeUnstageVolume", "not staged - ID", volumeId, "path", stagingPath, "subsystem", subsystemNQN)
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	subsystemNQN := s.subsystemOfDevice(device)
+	if subsystemNQN != "" {
+		s.subsystemLocks.Lock(subsystemNQN)
+		defer s.subsystemLocks.Unlock(subsystemNQN)
+	}
+
+	if err := mount.CleanupMountPoint(mountPoint, s.mounter, true); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeUnstageVolume error unmounting %s: %v", mountPoint, err)
+	}
+	if mountPoint != stagingPath {
+		if err := os.Remove(stagingPath); err != nil && !os.IsNotExist(err) {
+			return nil, status.Errorf(codes.Internal, "NodeUnstageVolume error removing %s: %v", stagingPath, err)
+		}
+	}
+	if out, err := s.exec.CommandContext(ctx, "blockdev", "--flushbufs", device).CombinedOutput(); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeUnstageVolume error flushing %s: %v: %s", device, err, out)
+	}
+
+	if subsystemNQN == "" {
+		slog.Warn("NodeUnstageVolume", "not an NVMe namespace, leaving connections alone - device", device)
+		if err := os.Remove(subsystemFile(stagingPath)); err != nil && !os.IsNotExist(err) {
+			return nil, status.Errorf(codes.Internal, "NodeUnstageVolume error removing %s: %v", subsystemFile(stagingPath), err)
+		}
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+	if err := s.disconnectStaged(stagingPath, subsystemNQN); err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeUnstageVolume error %v", err)
+	}
+
+	slog.Info("NodeUnstageVolume", "Finished - ID", volumeId, "device", device)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// disconnectStaged disconnects from the subsystem a volume was staged from,
+// unless another staged volume still uses it, and then forgets the subsystem.
+// The record is kept until then so a failed disconnect can be retried.
+func (s *NodeServer) disconnectStaged(stagingPath, subsystemNQN string) error {
+	if err := s.disconnectIfUnused(subsystemNQN); err != nil {
+		return err
+	}
+	if err := os.Remove(subsystemFile(stagingPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// disconnectIfUnused disconnects from the subsystem unless one of its
+// namespaces is still mounted for another staged volume.
+func (s *NodeServer) disconnectIfUnused(subsystemNQN string) error {
+	namespaces, err := s.nvme.NamespacesForSubsystem(subsystemNQN)
+	if err != nil {
+		return err
+	}
+	inUse, err := namespacesInUse(namespaces)
+	if err != nil {
+		return err
+	}
+	if len(inUse) > 0 {
+		slog.Info("disconnectIfUnused", "keeping connection to", subsystemNQN, "namespacesInUse", inUse)
+		return nil
+	}
+	return s.nvme.DisconnectSubsystem(subsystemNQN)
 }
 
 func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
@@ -165,18 +422,41 @@ func (s *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVo
 		err := fmt.Errorf("NodeExpandVolume error volumeId parameter was empty")
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	if req.VolumeCapability == nil {
-		err := fmt.Errorf("NodeExpandVolume error volumeCapability parameter was nil")
+	if req.GetVolumePath() == "" {
+		err := fmt.Errorf("NodeExpandVolume error volumePath parameter was empty")
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	if req.StagingTargetPath == "" {
-		err := fmt.Errorf("NodeExpandVolume error stagingTargetPath parameter was empty")
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+
+	volumePath := req.GetVolumePath()
+	device, isBlock, err := volumeDevice(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeExpandVolume error reading mounts: %v", err)
+	}
+	if device == "" {
+		return nil, status.Errorf(codes.NotFound, "NodeExpandVolume error volume is not mounted at %s", volumePath)
+	}
+	isBlock = isBlock || req.GetVolumeCapability().GetBlock() != nil
+
+	subsystemNQN := s.subsystemOfDevice(device)
+	if subsystemNQN == "" {
+		return nil, status.Errorf(codes.Internal, "NodeExpandVolume error %s is not an NVMe namespace", device)
+	}
+	size, err := s.waitForNVMeSize(ctx, device, subsystemNQN, req.GetCapacityRange().GetRequiredBytes())
+	if err != nil {
+		return nil, status.Errorf(codes.DeadlineExceeded, "NodeExpandVolume error %v", err)
+	}
+
+	if !isBlock {
+		// ext4 is grown through the device and xfs through its mount point,
+		// both while mounted.
+		resizer := mount.NewResizeFs(s.exec)
+		if _, err := resizer.Resize(device, volumePath); err != nil {
+			return nil, status.Errorf(codes.Internal, "NodeExpandVolume error growing the filesystem on %s: %v", device, err)
+		}
 	}
 
-	slog.Info("NodeExpandVolume", "Finished - ID", req.GetVolumeId())
-	response := csi.NodeExpandVolumeResponse{}
-	return &response, nil
+	slog.Info("NodeExpandVolume", "Finished - ID", req.GetVolumeId(), "device", device, "capacity", size)
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
 }
 
 func getNodeFQDN() string {
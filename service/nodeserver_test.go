@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"example.com/csiproject/internal/nvme"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestNodeUnstageVolumeFinishesDisconnect(t *testing.T) {
+	const subsystemNQN = "nqn.2024-02.com.example.csi:vol1"
+	sysfs := t.TempDir()
+	controller := filepath.Join(sysfs, "class", "nvme", "nvme1")
+	for _, dir := range []string{controller, filepath.Join(sysfs, "block")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(controller, "subsysnqn"), []byte(subsystemNQN+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A directory can't be written to, so the first disconnect fails.
+	deleteController := filepath.Join(controller, "delete_controller")
+	if err := os.Mkdir(deleteController, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// An earlier attempt unmounted the volume, leaving only the staging
+	// directory and the subsystem it was staged from.
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+	if err := os.Mkdir(stagingPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSubsystem(stagingPath, subsystemNQN); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &NodeServer{nvme: &nvme.Host{SysfsRoot: sysfs}}
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: "vol1", StagingTargetPath: stagingPath}
+	if _, err := s.NodeUnstageVolume(context.Background(), req); err == nil {
+		t.Fatal("NodeUnstageVolume() succeeded without disconnecting")
+	}
+	if saved, err := savedSubsystem(stagingPath); err != nil || saved != subsystemNQN {
+		t.Fatalf("subsystem after a failed disconnect = %q, %v, want it kept", saved, err)
+	}
+
+	if err := os.Remove(deleteController); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(deleteController, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NodeUnstageVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(deleteController); err != nil || string(b) != "1" {
+		t.Errorf("delete_controller = %q, %v, want the controller deleted", b, err)
+	}
+	for _, path := range []string{stagingPath, subsystemFile(stagingPath)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", path, err)
+		}
+	}
+
+	// Once done, further retries have nothing to do.
+	if _, err := s.NodeUnstageVolume(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+}
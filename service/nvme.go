@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"example.com/csiproject/backend/model"
+	"example.com/csiproject/internal/nvme"
+	"k8s.io/mount-utils"
+)
+
+const (
+	// deviceTimeout bounds how long staging waits for the namespace's block
+	// device to show up after connecting.
+	deviceTimeout = 30 * time.Second
+	// devicePollInterval is how often sysfs is checked while waiting.
+	devicePollInterval = 500 * time.Millisecond
+	// rescanDelay is how long to wait for a namespace to appear on its own
+	// before asking the controllers to rescan.
+	rescanDelay = 2 * time.Second
+)
+
+// nvmeTarget is where a volume's NVMe-oF subsystem is served from.
+type nvmeTarget struct {
+	Transport    string
+	Address      string
+	Port         string
+	SubsystemNQN string
+	// NamespaceUUID identifies the volume's namespace within the subsystem.
+	// Volumes created before the backend reported it have none.
+	NamespaceUUID string
+}
+
+// nvmeTargetFromContext reads the target from the publish context, falling
+// back to the volume context for any key the publish context doesn't set.
+func nvmeTargetFromContext(publishContext, volumeContext map[string]string) (nvmeTarget, error) {
+	get := func(key string) string {
+		if v := publishContext[key]; v != "" {
+			return v
+		}
+		return volumeContext[key]
+	}
+	t := nvmeTarget{
+		Transport:     get(model.ContextTransport),
+		Address:       get(model.ContextAddress),
+		Port:          get(model.ContextPort),
+		SubsystemNQN:  get(model.ContextSubsystemNQN),
+		NamespaceUUID: get(model.ContextNamespaceUUID),
+	}
+	if t.Transport == "" {
+		t.Transport = "tcp"
+	}
+	if t.Address == "" || t.Port == "" || t.SubsystemNQN == "" {
+		return t, fmt.Errorf("volume context is missing the %s, %s or %s of the NVMe target",
+			model.ContextAddress, model.ContextPort, model.ContextSubsystemNQN)
+	}
+	return t, nil
+}
+
+// connectNVMe connects to the target's subsystem, unless a controller for
+// the subsystem already exists.
+func (s *NodeServer) connectNVMe(t nvmeTarget) error {
+	controllers, err := s.nvme.ControllersForSubsystem(t.SubsystemNQN)
+	if err != nil {
+		return err
+	}
+	if len(controllers) > 0 {
+		slog.Debug("connectNVMe", "already connected", t.SubsystemNQN, "controller", controllers[0].Name)
+		return nil
+	}
+	// Connect as the NQN advertised in NodeGetInfo, the one the target
+	// was told to allow.
+	hostNQN, err := s.hostNQN()
+	if err != nil {
+		return err
+	}
+	c, err := s.nvme.Connect(nvme.ConnectOptions{
+		Transport:    t.Transport,
+		Address:      t.Address,
+		ServiceID:    t.Port,
+		SubsystemNQN: t.SubsystemNQN,
+		HostNQN:      hostNQN,
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("connectNVMe", "connected", t.SubsystemNQN, "controller", c.Name)
+	return nil
+}
+
+// findNVMeDevice returns the block device of the target's namespace, or ""
+// if it hasn't shown up yet. The namespace is found by its UUID, falling
+// back to the first namespace of the subsystem for volumes without one.
+func (s *NodeServer) findNVMeDevice(t nvmeTarget) (string, error) {
+	if t.NamespaceUUID == "" {
+		namespaces, err := s.nvme.NamespacesForSubsystem(t.SubsystemNQN)
+		if err != nil || len(namespaces) == 0 {
+			return "", err
+		}
+		return s.nvme.DevicePath(namespaces[0]), nil
+	}
+	ns, err := s.nvme.FindNamespace(t.NamespaceUUID)
+	if err == nvme.ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if ns.SubsystemNQN != t.SubsystemNQN {
+		return "", fmt.Errorf("namespace %s is %s in subsystem %s, not %s", t.NamespaceUUID, ns.Name, ns.SubsystemNQN, t.SubsystemNQN)
+	}
+	return s.nvme.DevicePath(ns), nil
+}
+
+// waitForNVMeDevice polls until the target's block device appears. Once the
+// subsystem has been connected for a while without the namespace showing
+// up, its controllers are asked to rescan on every poll.
+func (s *NodeServer) waitForNVMeDevice(ctx context.Context, t nvmeTarget) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, deviceTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(devicePollInterval)
+	defer ticker.Stop()
+	rescanAfter := time.Now().Add(rescanDelay)
+	for {
+		device, err := s.findNVMeDevice(t)
+		if err != nil {
+			return "", err
+		}
+		if device != "" {
+			return device, nil
+		}
+		if time.Now().After(rescanAfter) {
+			s.rescanSubsystem(t.SubsystemNQN)
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("no block device for namespace %q of %s after %s", t.NamespaceUUID, t.SubsystemNQN, deviceTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitForNVMeSize polls until the namespace behind the block device reports
+// at least sizeBytes, and returns the size it reports. The target announces
+// a new size to connected hosts on its own, but the subsystem's controllers
+// are asked to rescan anyway in case the announcement was missed.
+func (s *NodeServer) waitForNVMeSize(ctx context.Context, device, subsystemNQN string, sizeBytes int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, deviceTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(devicePollInterval)
+	defer ticker.Stop()
+	s.rescanSubsystem(subsystemNQN)
+	rescanAfter := time.Now().Add(rescanDelay)
+	for {
+		ns, err := s.nvme.Namespace(filepath.Base(device))
+		if err != nil {
+			return 0, err
+		}
+		if ns.SizeBytes >= sizeBytes {
+			return ns.SizeBytes, nil
+		}
+		if time.Now().After(rescanAfter) {
+			s.rescanSubsystem(subsystemNQN)
+			rescanAfter = time.Now().Add(rescanDelay)
+		}
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("namespace %s is still %d bytes, not %d, after %s", ns.Name, ns.SizeBytes, sizeBytes, deviceTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// rescanSubsystem asks every controller of the subsystem to rescan its
+// namespaces. Failures are only logged; the caller keeps polling anyway.
+func (s *NodeServer) rescanSubsystem(subsystemNQN string) {
+	controllers, err := s.nvme.ControllersForSubsystem(subsystemNQN)
+	if err != nil {
+		slog.Warn("rescanSubsystem", "subsystem", subsystemNQN, "error", err)
+		return
+	}
+	for _, c := range controllers {
+		if err := s.nvme.Rescan(c); err != nil {
+			slog.Warn("rescanSubsystem", "controller", c.Name, "error", err)
+		}
+	}
+}
+
+// subsystemOfDevice returns the NQN of the subsystem a block device such as
+// "/dev/nvme0n1" belongs to, or "" if it isn't an NVMe namespace.
+func (s *NodeServer) subsystemOfDevice(device string) string {
+	ns, err := s.nvme.Namespace(filepath.Base(device))
+	if err != nil {
+		return ""
+	}
+	return ns.SubsystemNQN
+}
+
+// namespacesInUse reports which of the namespaces are still mounted
+// anywhere, either as a filesystem or as a bind mounted device node.
+func namespacesInUse(namespaces []nvme.Namespace) (map[string]bool, error) {
+	mounts, err := mount.ParseMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool)
+	for _, ns := range namespaces {
+		for _, m := range mounts {
+			if fmt.Sprintf("%d:%d", m.Major, m.Minor) == ns.DevNum ||
+				(m.FsType == "devtmpfs" && m.Root == "/"+ns.Name) {
+				inUse[ns.Name] = true
+				break
+			}
+		}
+	}
+	return inUse, nil
+}